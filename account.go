@@ -1,6 +1,10 @@
 package main
 
 import (
+    "context"
+    "database/sql"
+    "errors"
+    "io"
     "net/http"
     "github.com/gorilla/mux"
     _ "github.com/lib/pq"
@@ -10,6 +14,10 @@ import (
     "log"
 )
 
+const DeletionGracePeriod = 30 * 24 * time.Hour
+
+var errDeactivated = errors.New("Account deactivated")
+
 type Account struct {
     Email       string      `json:"email"`
     DOB         time.Time   `json:"dob"`
@@ -30,19 +38,17 @@ func authenticationHandler(w http.ResponseWriter, r *http.Request, url string) {
     email, ok := checkAuthorisation(w,r)
 
     if ok {
+        path, err := profileUrlForEmail(r.Context(), email)
 
-        query := `SELECT firstname, lastname, url
-                FROM profile
-                WHERE email = $1;`
+        var p *Profile
 
-        var firstname string
-        var lastname string
-        var path string
-        row := db.QueryRow(query, email)
-        err := row.Scan(&firstname, &lastname, &path)
+        if err == nil {
+            p, err = loadProfile(r.Context(), path)
+        }
 
         if err != nil {
             http.Error(w, err.Error(), http.StatusInternalServerError)
+            return
         }
 
         err = json.NewEncoder(w).Encode(struct {
@@ -50,8 +56,8 @@ func authenticationHandler(w http.ResponseWriter, r *http.Request, url string) {
             LastName string `json:"lastname"`
             URL string `json:"url"`
         }{
-            FirstName: firstname,
-            LastName: lastname,
+            FirstName: p.FirstName,
+            LastName: p.LastName,
             URL: path,
         })
 
@@ -80,13 +86,14 @@ func registrationHandler(w http.ResponseWriter, r *http.Request, url string) {
         return
     }
     log.Println("Request processed")
-    err = createAccount(reg.Account.Email, reg.Account.DOB, reg.Password)
+    err = createAccount(r.Context(), reg.Account.Email, reg.Account.DOB, reg.Password)
 
     if err != nil {
         http.Error(w, err.Error(), http.StatusInternalServerError)
         return
     }
 
+    registrations.Inc()
     w.WriteHeader(http.StatusOK)
     log.Println("Account created");
 }
@@ -99,21 +106,53 @@ func accountHandler(w http.ResponseWriter, r *http.Request) {
     switch action {
     case "delete":
 
-        var email string
+        email, ok := checkAuthorisation(w,r)
 
-        if r.Body == nil {
-            http.Error(w, "Request body missing", http.StatusBadRequest)
+        if !ok {
             return
         }
 
-        err := json.NewDecoder(r.Body).Decode(&email)
+        // Accounts are deactivated for DeletionGracePeriod before being
+        // removed, unless the user asks for immediate deletion.
+        var req struct {
+            Immediate bool `json:"immediate"`
+        }
 
-        if err != nil {
+        err := json.NewDecoder(r.Body).Decode(&req)
+
+        if err != nil && err != io.EOF {
             http.Error(w, err.Error(), http.StatusBadRequest)
             return
         }
 
-        err = deleteAccount(email)
+        if req.Immediate {
+            err = deleteAccount(r.Context(), email)
+        } else {
+            err = deactivateAccount(r.Context(), email)
+        }
+
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+            return
+        }
+    case "restore":
+
+        email, password, ok := r.BasicAuth()
+
+        if !ok {
+            w.Header().Set("Authorization", "Basic realm=loggedin")
+            w.WriteHeader(401)
+            return
+        }
+
+        err := authenticate(r.Context(), email, password)
+
+        if err != nil && err != errDeactivated {
+            http.Error(w, err.Error(), http.StatusForbidden)
+            return
+        }
+
+        err = restoreAccount(r.Context(), email)
 
         if err != nil {
             http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -143,7 +182,7 @@ func accountHandler(w http.ResponseWriter, r *http.Request) {
             return
         }
 
-        err = changePassword(email, acct.Pwd)
+        err = changePassword(r.Context(), email, acct.Pwd)
 
         if err != nil {
             http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -154,20 +193,25 @@ func accountHandler(w http.ResponseWriter, r *http.Request) {
     }
 }
 
-func createAccount(email string, dob time.Time, password string) error {
+func createAccount(ctx context.Context, email string, dob time.Time, password string) error {
+    ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+    defer cancel()
+
     query := `INSERT INTO account (email, dob, password)
             VALUES ($1, $2, $3);`
 
     hashedPwd, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 
     if err == nil {
-        _, err = db.Exec(query, email, dob, hashedPwd)
+        _, err = db.ExecContext(ctx, query, email, dob, hashedPwd)
     }
 
     return err
 }
 
-func changePassword(email string, password string) error {
+func changePassword(ctx context.Context, email string, password string) error {
+    ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+    defer cancel()
 
     query := `UPDATE account
             SET password = $1
@@ -176,31 +220,186 @@ func changePassword(email string, password string) error {
     hashedPwd, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 
     if err == nil {
-        _, err = db.Exec(query, hashedPwd, email)
+        _, err = db.ExecContext(ctx, query, hashedPwd, email)
     }
     return err
 }
 
-func deleteAccount(email string) error {
-    query := `DELETE FROM account
+func deleteAccount(ctx context.Context, email string) error {
+    ctx, cancel := context.WithTimeout(ctx, purgeTimeout)
+    defer cancel()
+
+    tx, err := db.BeginTx(ctx, nil)
+
+    if err != nil {
+        return err
+    }
+
+    err = purgeAccount(ctx, tx, email)
+
+    if err != nil {
+        tx.Rollback()
+        return err
+    }
+
+    return tx.Commit()
+}
+
+func purgeAccount(ctx context.Context, tx *sql.Tx, email string) error {
+    query := `SELECT url
+            FROM profile
             WHERE email = $1;`
 
-    _, err := db.Exec(query, email)
+    rows, err := tx.QueryContext(ctx, query, email)
+
+    if err != nil {
+        return err
+    }
+
+    var urls []string
+
+    for rows.Next() {
+        var url string
+        err = rows.Scan(&url)
+
+        if err != nil {
+            rows.Close()
+            return err
+        }
+
+        urls = append(urls, url)
+    }
+
+    rows.Close()
+
+    for _, url := range urls {
+        err = purgeProfile(ctx, tx, url)
+
+        if err != nil {
+            return err
+        }
+    }
+
+    queries := []string{
+        `DELETE FROM search
+            WHERE acctEmail = $1;`,
+        // Expired exports are removed along with their files by the purger
+        `UPDATE export
+            SET expires = now()
+            WHERE acctEmail = $1;`,
+        `DELETE FROM account
+            WHERE email = $1;`,
+    }
+
+    for _, query := range queries {
+        _, err = tx.ExecContext(ctx, query, email)
+
+        if err != nil {
+            return err
+        }
+    }
+
+    return nil
+}
+
+func deactivateAccount(ctx context.Context, email string) error {
+    ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+    defer cancel()
+
+    query := `UPDATE account
+            SET deactivated = now()
+            WHERE email = $1;`
+
+    _, err := db.ExecContext(ctx, query, email)
+
+    if err == nil {
+        invalidateAccount(ctx, email)
+    }
+
+    return err
+}
+
+func restoreAccount(ctx context.Context, email string) error {
+    ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+    defer cancel()
+
+    query := `UPDATE account
+            SET deactivated = NULL
+            WHERE email = $1;`
+
+    _, err := db.ExecContext(ctx, query, email)
+
+    if err == nil {
+        invalidateAccount(ctx, email)
+    }
 
     return err
 }
 
-func authenticate(email string, password string) error {
-    query := `SELECT password
+func purgeDeactivatedAccounts(ctx context.Context) error {
+    query := `SELECT email
+            FROM account
+            WHERE deactivated < $1;`
+
+    qctx, cancel := context.WithTimeout(ctx, queryTimeout)
+    defer cancel()
+
+    rows, err := db.QueryContext(qctx, query, time.Now().Add(-DeletionGracePeriod))
+
+    if err != nil {
+        return err
+    }
+
+    var emails []string
+
+    for rows.Next() {
+        var email string
+        err = rows.Scan(&email)
+
+        if err != nil {
+            rows.Close()
+            return err
+        }
+
+        emails = append(emails, email)
+    }
+
+    rows.Close()
+
+    for _, email := range emails {
+        err = deleteAccount(ctx, email)
+
+        if err != nil {
+            return err
+        }
+
+        log.Println("Purged deactivated account " + email)
+    }
+
+    return nil
+}
+
+func authenticate(ctx context.Context, email string, password string) error {
+    ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+    defer cancel()
+
+    query := `SELECT password, deactivated IS NOT NULL
             FROM account
             WHERE email = $1;`
 
     var hashedPwd []byte
+    var deactivated bool
 
-    err := db.QueryRow(query, email).Scan(&hashedPwd)
+    err := db.QueryRowContext(ctx, query, email).Scan(&hashedPwd, &deactivated)
 
     if err == nil {
+        start := time.Now()
         err = bcrypt.CompareHashAndPassword(hashedPwd, []byte(password))
+        observeAuth(start, err)
+    }
+
+    if err == nil && deactivated {
+        err = errDeactivated
     }
 
     return err
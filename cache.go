@@ -0,0 +1,352 @@
+package main
+
+import (
+    "bytes"
+    "container/list"
+    "context"
+    "crypto/sha256"
+    "encoding/gob"
+    "encoding/hex"
+    "net/http"
+    "log"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+const CacheSize int = 10000
+
+// Entries are evicted on the writes that change them, so TTLs only bound how
+// long anything missed stays stale: a friend's new name in a friend list,
+// say.
+const (
+    profileTTL = 5 * time.Minute
+    friendsTTL = 5 * time.Minute
+    reactionTTL = time.Minute
+)
+
+// A store for cached reads. Values are opaque bytes, so a shared cache such
+// as memcached or Redis can stand in for the in-process one.
+type Cache interface {
+    Get(key string) ([]byte, bool)
+    Set(key string, value []byte, ttl time.Duration)
+    Delete(keys ...string)
+}
+
+var cache Cache = newLRUCache(CacheSize)
+
+// An in-process cache holding up to size entries, dropping the least
+// recently used when full.
+type lruCache struct {
+    sync.Mutex
+    size    int
+    order   *list.List
+    entries map[string]*list.Element
+}
+
+type lruEntry struct {
+    key     string
+    value   []byte
+    expires time.Time
+}
+
+func newLRUCache(size int) *lruCache {
+    return &lruCache{
+        size: size,
+        order: list.New(),
+        entries: make(map[string]*list.Element),
+    }
+}
+
+func (c *lruCache) Get(key string) ([]byte, bool) {
+    c.Lock()
+    defer c.Unlock()
+
+    el, ok := c.entries[key]
+
+    if !ok {
+        return nil, false
+    }
+
+    entry := el.Value.(*lruEntry)
+
+    if time.Now().After(entry.expires) {
+        c.order.Remove(el)
+        delete(c.entries, key)
+        return nil, false
+    }
+
+    c.order.MoveToFront(el)
+
+    return entry.value, true
+}
+
+func (c *lruCache) Set(key string, value []byte, ttl time.Duration) {
+    c.Lock()
+    defer c.Unlock()
+
+    expires := time.Now().Add(ttl)
+
+    if el, ok := c.entries[key]; ok {
+        entry := el.Value.(*lruEntry)
+        entry.value = value
+        entry.expires = expires
+        c.order.MoveToFront(el)
+        return
+    }
+
+    c.entries[key] = c.order.PushFront(&lruEntry{key, value, expires})
+
+    for c.order.Len() > c.size {
+        oldest := c.order.Back()
+        c.order.Remove(oldest)
+        delete(c.entries, oldest.Value.(*lruEntry).key)
+    }
+}
+
+func (c *lruCache) Delete(keys ...string) {
+    c.Lock()
+    defer c.Unlock()
+
+    for _, key := range keys {
+        if el, ok := c.entries[key]; ok {
+            c.order.Remove(el)
+            delete(c.entries, key)
+        }
+    }
+}
+
+const versionTTL = 24 * time.Hour
+
+// The key to store an entry under whose load may race with its
+// invalidation. Invalidating drops the version, so a load finishing after
+// it stores its result where nothing will look.
+func versionedKey(key string) string {
+    versionKey := "version/" + key
+    version, ok := cache.Get(versionKey)
+
+    if !ok {
+        version = []byte(strconv.FormatInt(time.Now().UnixNano(), 36))
+        cache.Set(versionKey, version, versionTTL)
+    }
+
+    return key + "@" + string(version)
+}
+
+func invalidateVersioned(keys ...string) {
+    versionKeys := make([]string, len(keys))
+
+    for i, key := range keys {
+        versionKeys[i] = "version/" + key
+    }
+
+    cache.Delete(versionKeys...)
+}
+
+// Decodes the cached value for key into dest, or calls load and caches what
+// it returns. Errors aren't cached. Values are stored encoded, so callers
+// never share what they get back.
+func readThrough(key string, ttl time.Duration, dest interface{}, load func() (interface{}, error)) error {
+    if data, ok := cache.Get(key); ok {
+        err := gob.NewDecoder(bytes.NewReader(data)).Decode(dest)
+
+        if err == nil {
+            return nil
+        }
+
+        log.Println("Cache entry " + key + ": " + err.Error())
+    }
+
+    value, err := load()
+
+    if err != nil {
+        return err
+    }
+
+    var buf bytes.Buffer
+    err = gob.NewEncoder(&buf).Encode(value)
+
+    if err != nil {
+        return err
+    }
+
+    cache.Set(key, buf.Bytes(), ttl)
+
+    return gob.NewDecoder(&buf).Decode(dest)
+}
+
+func profileKey(url string) string {
+    return "profile/" + url
+}
+
+func friendsKey(url string, relType string) string {
+    return "friends/" + url + "/" + relType
+}
+
+func emailKey(email string) string {
+    return "email/" + email
+}
+
+func urlKey(url string) string {
+    return "url/" + url
+}
+
+func reactionsKey(postId int) string {
+    return "reactions/" + strconv.Itoa(postId)
+}
+
+// Evicts the profiles' cached details and friend lists, for changes to the
+// profiles or their connections.
+func invalidateProfiles(urls ...string) {
+    var keys []string
+
+    for _, url := range urls {
+        keys = append(keys, profileKey(url), friendsKey(url, ""))
+
+        for relType := range relationshipTypes {
+            keys = append(keys, friendsKey(url, relType))
+        }
+    }
+
+    cache.Delete(keys...)
+}
+
+// Evicts every profile belonging to an account, for changes to the account
+// that hide or show them.
+func invalidateAccount(ctx context.Context, email string) {
+    query := `SELECT url
+            FROM profile
+            WHERE email = $1;`
+
+    rows, err := db.QueryContext(ctx, query, email)
+
+    if err != nil {
+        log.Println("Cache invalidation failed:", err)
+        return
+    }
+
+    defer rows.Close()
+
+    var urls []string
+
+    for rows.Next() {
+        var url string
+
+        if err = rows.Scan(&url); err != nil {
+            log.Println("Cache invalidation failed:", err)
+            return
+        }
+
+        urls = append(urls, url)
+    }
+
+    invalidateProfiles(urls...)
+}
+
+// Tags GET responses with a hash of their body and answers 304 when the
+// client already has it. Only successful responses that don't handle
+// conditional requests themselves, as files served with a modification time
+// do, are buffered; the rest pass straight through, as do streamed ones once
+// flushed. Responses vary with the user, so shared caches mustn't keep
+// authenticated ones.
+func etagMiddleware(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if r.Method != http.MethodGet {
+            next.ServeHTTP(w, r)
+            return
+        }
+
+        w.Header().Add("Vary", "Authorization")
+
+        if r.Header.Get("Authorization") != "" {
+            w.Header().Set("Cache-Control", "private")
+        }
+
+        rec := &etagRecorder{ResponseWriter: w}
+
+        next.ServeHTTP(rec, r)
+
+        if rec.passthrough {
+            return
+        }
+
+        sum := sha256.Sum256(rec.body.Bytes())
+        etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+        w.Header().Set("ETag", etag)
+
+        if etagMatches(r.Header.Get("If-None-Match"), etag) {
+            w.WriteHeader(http.StatusNotModified)
+            return
+        }
+
+        w.WriteHeader(http.StatusOK)
+        w.Write(rec.body.Bytes())
+    })
+}
+
+type etagRecorder struct {
+    http.ResponseWriter
+    body        bytes.Buffer
+    wroteHeader bool
+    passthrough bool
+}
+
+func (e *etagRecorder) WriteHeader(code int) {
+    if e.wroteHeader {
+        return
+    }
+
+    e.wroteHeader = true
+    header := e.ResponseWriter.Header()
+
+    if code != http.StatusOK || header.Get("ETag") != "" || header.Get("Last-Modified") != "" {
+        e.passthrough = true
+        e.ResponseWriter.WriteHeader(code)
+    }
+}
+
+func (e *etagRecorder) Write(b []byte) (int, error) {
+    if !e.wroteHeader {
+        e.WriteHeader(http.StatusOK)
+    }
+
+    if e.passthrough {
+        return e.ResponseWriter.Write(b)
+    }
+
+    return e.body.Write(b)
+}
+
+// Sends what has been buffered and stops buffering, so streaming handlers
+// still reach the client.
+func (e *etagRecorder) Flush() {
+    if !e.passthrough {
+        e.wroteHeader = true
+        e.passthrough = true
+        e.ResponseWriter.WriteHeader(http.StatusOK)
+        e.ResponseWriter.Write(e.body.Bytes())
+        e.body.Reset()
+    }
+
+    if f, ok := e.ResponseWriter.(http.Flusher); ok {
+        f.Flush()
+    }
+}
+
+func (e *etagRecorder) Unwrap() http.ResponseWriter {
+    return e.ResponseWriter
+}
+
+// Weak comparison, as If-None-Match calls for.
+func etagMatches(header string, etag string) bool {
+    for _, candidate := range strings.Split(header, ",") {
+        candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+
+        if candidate == "*" || candidate == etag {
+            return true
+        }
+    }
+
+    return false
+}
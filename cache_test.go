@@ -0,0 +1,66 @@
+package main
+
+import (
+    "net/http"
+    "net/http/httptest"
+    "testing"
+)
+
+func TestEtagMiddleware(t *testing.T) {
+    handler := etagMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.Write([]byte("feed"))
+    }))
+
+    r := httptest.NewRequest(http.MethodGet, "/feed", nil)
+    r.SetBasicAuth("someone@example.com", "password")
+    w := httptest.NewRecorder()
+    handler.ServeHTTP(w, r)
+
+    etag := w.Header().Get("ETag")
+
+    if w.Code != http.StatusOK || w.Body.String() != "feed" || etag == "" {
+        t.Fatalf("First request: %d %q with ETag %q", w.Code, w.Body.String(), etag)
+    }
+
+    if got := w.Header().Get("Cache-Control"); got != "private" {
+        t.Errorf("Authenticated response Cache-Control %q, want private", got)
+    }
+
+    if got := w.Header().Get("Vary"); got != "Authorization" {
+        t.Errorf("Vary %q, want Authorization", got)
+    }
+
+    r.Header.Set("If-None-Match", etag)
+    w = httptest.NewRecorder()
+    handler.ServeHTTP(w, r)
+
+    if w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+        t.Errorf("Matching request: %d %q, want 304 and no body", w.Code, w.Body.String())
+    }
+}
+
+func TestEtagMiddlewareFlushes(t *testing.T) {
+    var rec *httptest.ResponseRecorder
+
+    handler := etagMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.Write([]byte("event: 1\n"))
+        w.(http.Flusher).Flush()
+
+        if !rec.Flushed || rec.Body.String() != "event: 1\n" {
+            t.Errorf("Flush sent %q, flushed = %v", rec.Body.String(), rec.Flushed)
+        }
+
+        if http.NewResponseController(w).Flush() != nil {
+            t.Error("Flush not reachable through Unwrap")
+        }
+
+        w.Write([]byte("event: 2\n"))
+    }))
+
+    rec = httptest.NewRecorder()
+    handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/stream", nil))
+
+    if rec.Body.String() != "event: 1\nevent: 2\n" || rec.Header().Get("ETag") != "" {
+        t.Errorf("Streamed %q with ETag %q", rec.Body.String(), rec.Header().Get("ETag"))
+    }
+}
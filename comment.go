@@ -1,11 +1,14 @@
 package main
 
 import(
+    "context"
     "net/http"
+    "github.com/gorilla/mux"
     "database/sql"
     _ "github.com/lib/pq"
     "encoding/json"
     "log"
+    "strconv"
     "time"
 )
 
@@ -14,36 +17,40 @@ type Comment struct {
     AuthorUrl   string      `json:"authorUrl"`
     Timestamp   time.Time   `json:"timestamp"`
     Content     string      `json:"content"`
+    Entities    []Entity    `json:"entities,omitempty"`
+    Edited      bool        `json:"edited"`
+    LastEdited  *time.Time  `json:"lastEdited,omitempty"`
 }
 
-func commentHandler(w http.ResponseWriter, r *http.Request, url string) {
+func commentHandler(w http.ResponseWriter, r *http.Request) {
+    vars := mux.Vars(r)
+    action := vars["action"]
+    id := vars["id"]
 
-    path := connectPath.FindStringSubmatch(url)
-
-    if path == nil {
-        http.NotFound(w,r)
-        return
-    }
-
-    switch path[1] {
+    switch action {
     case "get":
-        if len(path) < 3 {
+        if id == "" {
             http.NotFound(w, r)
             return
         }
 
-        c, err := loadComment(path[2])
+        viewer, ok := optionalViewer(w, r)
+
+        if !ok {
+            return
+        }
+
+        c, err := loadComment(r.Context(), id, viewer)
+
+        if err == sql.ErrNoRows {
+            http.NotFound(w, r)
+            return
+        }
 
         if err != nil {
-            if err != sql.ErrNoRows {
-                http.NotFound(w, r)
-                log.Println(err)
-                return
-            } else {
-                http.Error(w, err.Error(), http.StatusInternalServerError)
-                log.Println(err)
-                return
-            }
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+            log.Println(err)
+            return
         }
 
         err = json.NewEncoder(w).Encode(c)
@@ -58,29 +65,69 @@ func commentHandler(w http.ResponseWriter, r *http.Request, url string) {
             return
         }
 
+        email, ok := checkAuthorisation(w, r)
+
+        if !ok {
+            return
+        }
+
+        author, err := profileUrlForEmail(r.Context(), email)
+
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusForbidden)
+            return
+        }
+
         var c Comment
-        err := json.NewDecoder(r.Body).Decode(&c)
+        err = json.NewDecoder(r.Body).Decode(&c)
 
         if err != nil {
             http.Error(w, err.Error(), http.StatusBadRequest)
             return
         }
 
-        err = createComment(c)
+        c.AuthorUrl = author
+
+        err = createComment(r.Context(), c)
+
+        if err == sql.ErrNoRows {
+            http.NotFound(w, r)
+            return
+        }
 
         if err != nil {
             http.Error(w, err.Error(), http.StatusInternalServerError)
             return
         }
 
+        commentsCreated.Inc()
+
         w.WriteHeader(http.StatusOK)
     case "delete":
-        if len(path) < 3 {
+        if id == "" {
             http.NotFound(w, r)
             return
         }
 
-        err := deleteComment(path[2])
+        email, ok := checkAuthorisation(w, r)
+
+        if !ok {
+            return
+        }
+
+        user, err := profileUrlForEmail(r.Context(), email)
+
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusForbidden)
+            return
+        }
+
+        err = deleteComment(r.Context(), id, user)
+
+        if err == sql.ErrNoRows {
+            http.NotFound(w, r)
+            return
+        }
 
         if err != nil {
             http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -89,20 +136,43 @@ func commentHandler(w http.ResponseWriter, r *http.Request, url string) {
 
         w.WriteHeader(http.StatusOK)
     case "modify":
-        if r.Body == nil || len(path) < 3 {
+        if r.Body == nil || id == "" {
             http.Error(w, "Request incomplete", http.StatusBadRequest)
             return
         }
 
+        email, ok := checkAuthorisation(w, r)
+
+        if !ok {
+            return
+        }
+
+        author, err := profileUrlForEmail(r.Context(), email)
+
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusForbidden)
+            return
+        }
+
         var c Comment
-        err := json.NewDecoder(r.Body).Decode(&c)
+        err = json.NewDecoder(r.Body).Decode(&c)
 
         if err != nil {
             http.Error(w, err.Error(), http.StatusBadRequest)
             return
         }
 
-        err = editComment(path[2], c.Content)
+        err = editComment(r.Context(), id, author, c.Content)
+
+        if err == errEditWindow || err == errNotPermitted {
+            http.Error(w, err.Error(), http.StatusForbidden)
+            return
+        }
+
+        if err == sql.ErrNoRows {
+            http.NotFound(w, r)
+            return
+        }
 
         if err != nil {
             http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -116,49 +186,163 @@ func commentHandler(w http.ResponseWriter, r *http.Request, url string) {
     }
 }
 
+// Loads a comment for viewer, who must be able to see the post it is on.
+func loadComment(ctx context.Context, id string, viewer string) (*Comment, error) {
+    ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+    defer cancel()
 
-func loadComment(id string) (*Comment, error) {
-
-    query := `SELECT postid, authorurl, timestamp, content
-            FROM comment
-            WHERE id = $1;`
+    query := `SELECT c.postid, c.authorurl, c.timestamp, c.content, c.edited
+            FROM comment c, post p
+            WHERE c.id = $1
+            AND p.id = c.postid
+            AND c.deleted IS NULL
+            AND ` + postVisibleCondition + `;`
 
     var c Comment
-    err := db.QueryRow(query, id).Scan(&(c.PostId), &(c.AuthorUrl), 
-            &(c.Timestamp), &(c.Content))
+    err := db.QueryRowContext(ctx, query, id, viewer).Scan(&(c.PostId), &(c.AuthorUrl), 
+            &(c.Timestamp), &(c.Content), &(c.LastEdited))
 
     if err != nil {
         return nil, err
     }
 
+    commentId, err := strconv.Atoi(id)
+
+    if err != nil {
+        return nil, err
+    }
+
+    entities, err := loadEntities(ctx, "commentid", []int{commentId})
+
+    if err != nil {
+        return nil, err
+    }
+
+    c.Entities = entities[commentId]
+    c.Edited = c.LastEdited != nil
+
     return &c, nil
 }
 
-func createComment(comment Comment) error {
-    query := `INSERT INTO post (postid, authorurl, timestamp, content)
-            VALUES ($1, $2, $3, $4);`
+func createComment(ctx context.Context, comment Comment) error {
+    ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+    defer cancel()
+
+    visible, err := postVisible(ctx, comment.PostId, comment.AuthorUrl)
+
+    if err != nil {
+        return err
+    }
+
+    if !visible {
+        return sql.ErrNoRows
+    }
 
-    _, err := db.Exec(query, comment.PostId, comment.AuthorUrl,
-            comment.Timestamp, comment.Content)
+    tx, err := db.BeginTx(ctx, nil)
 
-    return err
+    if err != nil {
+        return err
+    }
+
+    defer tx.Rollback()
+
+    // The server's clock, not the client's, so the edit window holds.
+    query := `INSERT INTO comment (postid, authorurl, timestamp, content)
+            VALUES ($1, $2, now(), $3)
+            RETURNING id;`
+
+    var id int
+    err = tx.QueryRowContext(ctx, query, comment.PostId, comment.AuthorUrl,
+            comment.Content).Scan(&id)
+
+    if err != nil {
+        return err
+    }
+
+    mentioned, err := saveEntities(ctx, tx, "commentid", id, comment.Content)
+
+    if err != nil {
+        return err
+    }
+
+    err = tx.Commit()
+
+    if err != nil {
+        return err
+    }
+
+    notifyMentions(ctx, mentioned, comment.AuthorUrl, comment.PostId, id)
+
+    return nil
 }
 
-func deleteComment(id string) error {
-    query := `DELETE FROM comment
-            WHERE id = $1;`
+// Moves user's comment to the trash. sql.ErrNoRows if they didn't write it.
+func deleteComment(ctx context.Context, id string, user string) error {
+    ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+    defer cancel()
+
+    query := `UPDATE comment
+            SET deleted = now()
+            WHERE id = $1
+            AND authorurl = $2
+            AND deleted IS NULL;`
+
+    res, err := db.ExecContext(ctx, query, id, user)
 
-    _, err := db.Exec(query, id)
+    if err != nil {
+        return err
+    }
 
-    return err
+    if n, _ := res.RowsAffected(); n == 0 {
+        return sql.ErrNoRows
+    }
+
+    return nil
 }
 
-func editComment(id string, content string) error {
+func editComment(ctx context.Context, id string, author string, content string) error {
+    ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+    defer cancel()
+
+    tx, err := db.BeginTx(ctx, nil)
+
+    if err != nil {
+        return err
+    }
+
+    defer tx.Rollback()
+
+    changed, err := saveRevision(ctx, tx, "comment", id, author, content)
+
+    if err != nil || !changed {
+        return err
+    }
+
     query := `UPDATE comment
-            SET content = $1
-            WHERE id = $2;`
+            SET content = $1, edited = now()
+            WHERE id = $2
+            RETURNING id, postid;`
+
+    var commentId, postId int
+    err = tx.QueryRowContext(ctx, query, content, id).Scan(&commentId, &postId)
+
+    if err != nil {
+        return err
+    }
+
+    mentioned, err := saveEntities(ctx, tx, "commentid", commentId, content)
+
+    if err != nil {
+        return err
+    }
+
+    err = tx.Commit()
+
+    if err != nil {
+        return err
+    }
 
-    _, err := db.Exec(query, content, id)
+    notifyMentions(ctx, mentioned, author, postId, commentId)
 
-    return err
+    return nil
 }
@@ -0,0 +1,38 @@
+package main
+
+import (
+    "log"
+    "os"
+    "strconv"
+    "time"
+)
+
+// Deadlines for individual data operations. Feed and search queries scan
+// far more rows than single-row lookups, so they are given longer, and
+// purges run several statements that may each remove a lot.
+var (
+    queryTimeout = 5 * time.Second
+    feedTimeout = 10 * time.Second
+    searchTimeout = 10 * time.Second
+    purgeTimeout = 2 * time.Minute
+)
+
+const defaultStatementTimeout = 30 * time.Second
+
+// Server-side limit on any single statement, in milliseconds, taken from
+// NETWRK_STATEMENT_TIMEOUT (e.g. "15s") when set.
+func statementTimeout() string {
+    timeout := defaultStatementTimeout
+
+    if env := os.Getenv("NETWRK_STATEMENT_TIMEOUT"); env != "" {
+        d, err := time.ParseDuration(env)
+
+        if err != nil {
+            log.Println("Invalid NETWRK_STATEMENT_TIMEOUT: " + err.Error())
+        } else {
+            timeout = d
+        }
+    }
+
+    return strconv.FormatInt(int64(timeout / time.Millisecond), 10)
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+    "context"
+    "net/http"
+    "github.com/gorilla/mux"
+    "database/sql"
+    _ "github.com/lib/pq"
+    "encoding/json"
+    "errors"
+    "log"
+    "strconv"
+    "time"
+)
+
+const schedulerBatch int = 100
+
+var errPastSchedule = errors.New("Publish time has already passed")
+
+// A post that hasn't been published yet, seen only by its author. Drafts
+// with a PublishAt time are scheduled and published by the scheduler once
+// it passes; those without wait until published by hand.
+type Draft struct {
+    ID          int         `json:"id"`
+    ProfileUrl  string      `json:"profileUrl"`
+    Content     string      `json:"content"`
+    GroupUrl    string      `json:"groupUrl,omitempty"`
+    EventId     int         `json:"eventId,omitempty"`
+    PublishAt   *time.Time  `json:"publishAt,omitempty"`
+    Updated     time.Time   `json:"updated"`
+}
+
+func draftHandler(w http.ResponseWriter, r *http.Request) {
+    vars := mux.Vars(r)
+    action := vars["action"]
+    id := vars["id"]
+
+    email, ok := checkAuthorisation(w, r)
+
+    if !ok {
+        return
+    }
+
+    user, err := profileUrlForEmail(r.Context(), email)
+
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusForbidden)
+        return
+    }
+
+    var result interface{}
+
+    switch action {
+    case "get":
+        result, err = loadDrafts(r.Context(), user)
+    case "new", "modify":
+        var d Draft
+        err = json.NewDecoder(r.Body).Decode(&d)
+
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusBadRequest)
+            return
+        }
+
+        if d.ProfileUrl == "" {
+            d.ProfileUrl = user
+        }
+
+        if d.PublishAt != nil && d.PublishAt.Before(time.Now()) {
+            http.Error(w, errPastSchedule.Error(), http.StatusBadRequest)
+            return
+        }
+
+        if action == "new" {
+            result, err = createDraft(r.Context(), user, d)
+        } else {
+            err = modifyDraft(r.Context(), id, user, d)
+        }
+    case "cancel":
+        err = cancelDraft(r.Context(), id, user)
+    case "publish":
+        var draftId int
+        draftId, err = strconv.Atoi(id)
+
+        if err != nil {
+            http.NotFound(w, r)
+            return
+        }
+
+        err = publishDraft(r.Context(), draftId, user, false)
+    default:
+        http.NotFound(w, r)
+        return
+    }
+
+    if err != nil {
+        switch err {
+        case sql.ErrNoRows:
+            http.NotFound(w, r)
+        case errNotPermitted:
+            http.Error(w, err.Error(), http.StatusForbidden)
+        default:
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+        }
+
+        return
+    }
+
+    if result == nil {
+        w.WriteHeader(http.StatusOK)
+        return
+    }
+
+    err = json.NewEncoder(w).Encode(result)
+
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        log.Println(err)
+    }
+}
+
+// Returns the draft with its new id.
+func createDraft(ctx context.Context, author string, d Draft) (*Draft, error) {
+    ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+    defer cancel()
+
+    query := `INSERT INTO draft (authorurl, profileurl, content, groupurl, eventid, publishat)
+            VALUES ($1, $2, $3, NULLIF($4, ''), NULLIF($5, 0), $6)
+            RETURNING id, updated;`
+
+    err := db.QueryRowContext(ctx, query, author, d.ProfileUrl, d.Content, d.GroupUrl,
+            d.EventId, localTime(d.PublishAt)).Scan(&d.ID, &d.Updated)
+
+    if err != nil {
+        return nil, err
+    }
+
+    return &d, nil
+}
+
+func modifyDraft(ctx context.Context, id string, author string, d Draft) error {
+    ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+    defer cancel()
+
+    query := `UPDATE draft
+            SET profileurl = $3, content = $4, groupurl = NULLIF($5, ''),
+                eventid = NULLIF($6, 0), publishat = $7, updated = now()
+            WHERE id = $1
+            AND authorurl = $2;`
+
+    res, err := db.ExecContext(ctx, query, id, author, d.ProfileUrl, d.Content, d.GroupUrl,
+            d.EventId, localTime(d.PublishAt))
+
+    if err != nil {
+        return err
+    }
+
+    if n, _ := res.RowsAffected(); n == 0 {
+        return sql.ErrNoRows
+    }
+
+    return nil
+}
+
+// Discards a draft, or cancels a scheduled post.
+func cancelDraft(ctx context.Context, id string, author string) error {
+    ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+    defer cancel()
+
+    query := `DELETE FROM draft
+            WHERE id = $1
+            AND authorurl = $2;`
+
+    res, err := db.ExecContext(ctx, query, id, author)
+
+    if err != nil {
+        return err
+    }
+
+    if n, _ := res.RowsAffected(); n == 0 {
+        return sql.ErrNoRows
+    }
+
+    return nil
+}
+
+// Scheduled drafts first, soonest first, then unscheduled ones most recently
+// edited first.
+func loadDrafts(ctx context.Context, author string) ([]Draft, error) {
+    ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+    defer cancel()
+
+    query := `SELECT id, profileurl, content, COALESCE(groupurl, ''), COALESCE(eventid, 0),
+                publishat, updated
+            FROM draft
+            WHERE authorurl = $1
+            ORDER BY publishat NULLS LAST, updated DESC;`
+
+    rows, err := db.QueryContext(ctx, query, author)
+
+    if err != nil {
+        return nil, err
+    }
+
+    defer rows.Close()
+
+    drafts := []Draft{}
+
+    for rows.Next() {
+        var d Draft
+        err = rows.Scan(&d.ID, &d.ProfileUrl, &d.Content, &d.GroupUrl, &d.EventId,
+                &d.PublishAt, &d.Updated)
+
+        if err != nil {
+            return nil, err
+        }
+
+        drafts = append(drafts, d)
+    }
+
+    return drafts, rows.Err()
+}
+
+// Turns a draft into a post. The draft is removed in the same transaction,
+// so a draft is never published twice however many schedulers are running.
+// scheduled limits this to drafts whose publish time has passed. A scheduled
+// draft the author may no longer post is kept as an unscheduled draft and
+// the author told.
+func publishDraft(ctx context.Context, id int, author string, scheduled bool) error {
+    ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+    defer cancel()
+
+    tx, err := db.BeginTx(ctx, nil)
+
+    if err != nil {
+        return err
+    }
+
+    defer tx.Rollback()
+
+    query := `DELETE FROM draft
+            WHERE id = $1
+            AND authorurl = $2
+            AND (NOT $3 OR publishat <= now())
+            RETURNING profileurl, content, COALESCE(groupurl, ''), COALESCE(eventid, 0);`
+
+    post := Post{AuthorUrl: author}
+    err = tx.QueryRowContext(ctx, query, id, author, scheduled).Scan(&post.ProfileUrl,
+            &post.Content, &post.GroupUrl, &post.EventId)
+
+    if err != nil {
+        return err
+    }
+
+    postId, mentioned, err := insertPost(ctx, tx, post)
+
+    if scheduled && (err == errNotPermitted || err == sql.ErrNoRows) {
+        tx.Rollback()
+        return unscheduleDraft(ctx, id, author)
+    }
+
+    if err != nil {
+        return err
+    }
+
+    err = tx.Commit()
+
+    if err != nil {
+        return err
+    }
+
+    postsCreated.Inc()
+
+    notifyMentions(ctx, mentioned, author, postId, 0)
+    warmPreview(ctx, post.Content)
+    fanOut(ctx, postId)
+
+    if scheduled {
+        err = notify(ctx, author, NotifyPublished, "", postId, 0)
+    }
+
+    return err
+}
+
+func unscheduleDraft(ctx context.Context, id int, author string) error {
+    query := `UPDATE draft
+            SET publishat = NULL
+            WHERE id = $1;`
+
+    _, err := db.ExecContext(ctx, query, id)
+
+    if err != nil {
+        return err
+    }
+
+    return notify(ctx, author, NotifyPublishFailed, "", 0, 0)
+}
+
+// Publishes scheduled drafts that are due. A draft that fails is logged and
+// left for the next run rather than holding up the rest.
+func publishScheduled(ctx context.Context) error {
+    qctx, cancel := context.WithTimeout(ctx, queryTimeout)
+    defer cancel()
+
+    query := `SELECT id, authorurl
+            FROM draft
+            WHERE publishat <= now()
+            ORDER BY publishat
+            LIMIT $1;`
+
+    rows, err := db.QueryContext(qctx, query, schedulerBatch)
+
+    if err != nil {
+        return err
+    }
+
+    type due struct {
+        id      int
+        author  string
+    }
+
+    var drafts []due
+
+    for rows.Next() {
+        var d due
+        err = rows.Scan(&d.id, &d.author)
+
+        if err != nil {
+            rows.Close()
+            return err
+        }
+
+        drafts = append(drafts, d)
+    }
+
+    rows.Close()
+
+    if err = rows.Err(); err != nil {
+        return err
+    }
+
+    for _, d := range drafts {
+        err = publishDraft(ctx, d.id, d.author, true)
+
+        // Another scheduler got there first, or the author changed it.
+        if err == sql.ErrNoRows {
+            continue
+        }
+
+        if err != nil {
+            log.Println("Publishing draft " + strconv.Itoa(d.id) + ": " + err.Error())
+        }
+    }
+
+    return nil
+}
+
+// The database stores times without a zone, in the server's local time.
+func localTime(t *time.Time) interface{} {
+    if t == nil {
+        return nil
+    }
+
+    return t.Local()
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+    "context"
+    "net/http"
+    "github.com/gorilla/mux"
+    "database/sql"
+    "github.com/lib/pq"
+    "encoding/json"
+    "log"
+    "regexp"
+    "strconv"
+    "strings"
+    "time"
+    "unicode/utf8"
+)
+
+const (
+    EntityMention = "mention"
+    EntityHashtag = "hashtag"
+)
+
+const NumTrending int = 10
+const TrendingWindow = 24 * time.Hour
+const maxTrendingWindow = 7 * 24 * time.Hour
+
+// Go's regexp has no lookbehind, so the character before the marker is
+// matched too and the entity is taken from the second group. This keeps
+// email addresses and URL fragments from being read as entities.
+var (
+    mentionPattern = regexp.MustCompile(`(^|[^\w@])@([a-zA-Z0-9_-]+(?:\.[a-zA-Z0-9_-]+)*)`)
+    hashtagPattern = regexp.MustCompile(`(^|[^\w#&/])#([\p{L}\p{N}_]*\p{L}[\p{L}\p{N}_]*)`)
+)
+
+// Posts anyone may see: those by public profiles on their own walls, and
+// those in public groups.
+const publicPostCondition = `((p.groupurl IS NULL
+                    AND p.eventid IS NULL
+                    AND p.profileurl = p.authorurl
+                    AND EXISTS (SELECT *
+                                FROM profile a
+                                WHERE a.url = p.authorurl
+                                AND NOT a.private))
+                OR EXISTS (SELECT *
+                            FROM groups g
+                            WHERE g.url = p.groupurl
+                            AND g.privacy = 'public'))`
+
+// A mention or hashtag within post or comment content. Offset and Length
+// count characters rather than bytes. Value is the mentioned profile's url
+// or the tag in lower case without its '#'.
+type Entity struct {
+    Type        string      `json:"type"`
+    Value       string      `json:"value"`
+    Offset      int         `json:"offset"`
+    Length      int         `json:"length"`
+}
+
+type Trend struct {
+    Tag         string      `json:"tag"`
+    Count       int         `json:"count"`
+}
+
+func extractEntities(content string) []Entity {
+    var entities []Entity
+
+    for _, p := range []struct {
+        kind    string
+        pattern *regexp.Regexp
+    }{{EntityMention, mentionPattern}, {EntityHashtag, hashtagPattern}} {
+        for _, m := range p.pattern.FindAllStringSubmatchIndex(content, -1) {
+            // The marker sits just before the second group.
+            start, end := m[4] - 1, m[5]
+            value := content[m[4]:m[5]]
+
+            if p.kind == EntityHashtag {
+                value = strings.ToLower(value)
+            }
+
+            entities = append(entities, Entity{
+                Type: p.kind,
+                Value: value,
+                Offset: utf8.RuneCountInString(content[:start]),
+                Length: utf8.RuneCountInString(content[start:end]),
+            })
+        }
+    }
+
+    return entities
+}
+
+// Replaces the entities stored for a post or comment, where column is
+// "postid" or "commentid". Mentions of profiles that don't exist are
+// dropped. Entities kept through an edit keep their creation time, so old
+// hashtags don't trend again. Returns the profiles mentioned now that
+// weren't before, so edits don't notify anyone twice.
+func saveEntities(ctx context.Context, tx *sql.Tx, column string, id int, content string) ([]string, error) {
+    query := `DELETE FROM entity
+            WHERE ` + column + ` = $1
+            RETURNING kind, value, created;`
+
+    rows, err := tx.QueryContext(ctx, query, id)
+
+    if err != nil {
+        return nil, err
+    }
+
+    previous := make(map[string]bool)
+    created := make(map[Entity]time.Time)
+
+    for rows.Next() {
+        var kind, value string
+        var c time.Time
+        err = rows.Scan(&kind, &value, &c)
+
+        if err != nil {
+            rows.Close()
+            return nil, err
+        }
+
+        if kind == EntityMention {
+            previous[value] = true
+        }
+
+        key := Entity{Type: kind, Value: value}
+
+        if t, ok := created[key]; !ok || c.Before(t) {
+            created[key] = c
+        }
+    }
+
+    rows.Close()
+
+    if err = rows.Err(); err != nil {
+        return nil, err
+    }
+
+    query = `INSERT INTO entity (kind, ` + column + `, value, start, length, created)
+            SELECT $1, $2, $3, $4, $5, COALESCE($6::timestamp, now())
+            WHERE $1 = 'hashtag'
+            OR EXISTS (SELECT *
+                        FROM profile
+                        WHERE url = $3);`
+
+    var mentioned []string
+
+    for _, e := range extractEntities(content) {
+        var since *time.Time
+
+        if c, ok := created[Entity{Type: e.Type, Value: e.Value}]; ok {
+            since = &c
+        }
+
+        res, err := tx.ExecContext(ctx, query, e.Type, id, e.Value, e.Offset, e.Length, since)
+
+        if err != nil {
+            return nil, err
+        }
+
+        if n, _ := res.RowsAffected(); n == 1 && e.Type == EntityMention && !previous[e.Value] {
+            previous[e.Value] = true
+            mentioned = append(mentioned, e.Value)
+        }
+    }
+
+    return mentioned, nil
+}
+
+// Notifies mentioned profiles that can see the post the mention is in.
+// Failures are only logged since the content itself has been saved.
+func notifyMentions(ctx context.Context, mentioned []string, author string, postId int, commentId int) {
+    for _, url := range mentioned {
+        if url == author {
+            continue
+        }
+
+        visible, err := postVisible(ctx, postId, url)
+
+        if err == nil && visible {
+            err = notify(ctx, url, NotifyMention, author, postId, commentId)
+        }
+
+        if err != nil {
+            log.Println("Mention notification failed:", err)
+        }
+    }
+}
+
+// Entities for each of the given posts or comments, keyed by id.
+func loadEntities(ctx context.Context, column string, ids []int) (map[int][]Entity, error) {
+    query := `SELECT ` + column + `, kind, value, start, length
+            FROM entity
+            WHERE ` + column + ` = ANY($1)
+            ORDER BY start;`
+
+    rows, err := db.QueryContext(ctx, query, pq.Array(ids))
+
+    if err != nil {
+        return nil, err
+    }
+
+    defer rows.Close()
+
+    entities := make(map[int][]Entity)
+
+    for rows.Next() {
+        var id int
+        var e Entity
+        err = rows.Scan(&id, &e.Type, &e.Value, &e.Offset, &e.Length)
+
+        if err != nil {
+            return nil, err
+        }
+
+        entities[id] = append(entities[id], e)
+    }
+
+    return entities, rows.Err()
+}
+
+// Recent public posts carrying a hashtag, newest first, paged with
+// ?before.
+func hashtagHandler(w http.ResponseWriter, r *http.Request) {
+    vars := mux.Vars(r)
+    tag := strings.ToLower(strings.TrimPrefix(vars["tag"], "#"))
+
+    viewer, ok := optionalViewer(w, r)
+
+    if !ok {
+        return
+    }
+
+    var before time.Time
+
+    if b := r.URL.Query().Get("before"); b != "" {
+        var err error
+        before, err = time.Parse(time.RFC3339Nano, b)
+
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusBadRequest)
+            return
+        }
+    }
+
+    posts, err := getHashtagPosts(r.Context(), tag, viewer, before)
+
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    err = json.NewEncoder(w).Encode(posts)
+
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        log.Println(err)
+    }
+}
+
+// The most used hashtags in public posts and their comments over the last
+// ?hours, 24 by default and at most a week.
+func trendingHandler(w http.ResponseWriter, r *http.Request) {
+    window := TrendingWindow
+
+    if h := r.URL.Query().Get("hours"); h != "" {
+        hours, err := strconv.Atoi(h)
+
+        if err != nil || hours < 1 {
+            http.Error(w, "Invalid hours", http.StatusBadRequest)
+            return
+        }
+
+        window = time.Duration(hours) * time.Hour
+    }
+
+    if window > maxTrendingWindow {
+        window = maxTrendingWindow
+    }
+
+    trends, err := loadTrending(r.Context(), window)
+
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    err = json.NewEncoder(w).Encode(trends)
+
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        log.Println(err)
+    }
+}
+
+func getHashtagPosts(ctx context.Context, tag string, viewer string, before time.Time) ([]Post, error) {
+    ctx, cancel := context.WithTimeout(ctx, feedTimeout)
+    defer cancel()
+
+    if before.IsZero() {
+        before = time.Now()
+    }
+
+    query := `SELECT p.id, p.profileurl, p.authorurl, COALESCE(p.groupurl, ''), p.timestamp,
+                p.content
+            FROM post p
+            WHERE EXISTS (SELECT *
+                        FROM entity e
+                        WHERE e.postid = p.id
+                        AND e.kind = 'hashtag'
+                        AND e.value = $1)
+            AND p.deleted IS NULL
+            AND p.timestamp < $2
+            AND ` + publicPostCondition + `
+            AND NOT EXISTS (SELECT *
+                            FROM block b
+                            WHERE (b.blocker = $3 AND b.blocked = p.authorurl)
+                            OR (b.blocker = p.authorurl AND b.blocked = $3))
+            ORDER BY p.timestamp DESC
+            LIMIT $4;`
+
+    rows, err := db.QueryContext(ctx, query, tag, before, viewer, PostsPerRequest)
+
+    if err != nil {
+        return nil, err
+    }
+
+    defer rows.Close()
+
+    results := []Post{}
+
+    for rows.Next() {
+        var post Post
+        err = rows.Scan(&post.ID, &post.ProfileUrl, &post.AuthorUrl, &post.GroupUrl,
+                &post.Timestamp, &post.Content)
+
+        if err != nil {
+            return nil, err
+        }
+
+        results = append(results, post)
+    }
+
+    if err = rows.Err(); err != nil {
+        return nil, err
+    }
+
+    return results, decoratePosts(ctx, results, viewer)
+}
+
+func loadTrending(ctx context.Context, window time.Duration) ([]Trend, error) {
+    ctx, cancel := context.WithTimeout(ctx, searchTimeout)
+    defer cancel()
+
+    query := `SELECT e.value, COUNT(*)
+            FROM entity e
+            LEFT JOIN comment c ON c.id = e.commentid
+            JOIN post p ON p.id = COALESCE(e.postid, c.postid)
+            WHERE e.kind = 'hashtag'
+            AND e.created > now() - $1 * interval '1 second'
+            AND p.deleted IS NULL
+            AND c.deleted IS NULL
+            AND ` + publicPostCondition + `
+            GROUP BY e.value
+            ORDER BY COUNT(*) DESC, e.value
+            LIMIT $2;`
+
+    rows, err := db.QueryContext(ctx, query, window.Seconds(), NumTrending)
+
+    if err != nil {
+        return nil, err
+    }
+
+    defer rows.Close()
+
+    trends := []Trend{}
+
+    for rows.Next() {
+        var t Trend
+        err = rows.Scan(&t.Tag, &t.Count)
+
+        if err != nil {
+            return nil, err
+        }
+
+        trends = append(trends, t)
+    }
+
+    return trends, rows.Err()
+}
@@ -0,0 +1,572 @@
+package main
+
+import (
+    "context"
+    "database/sql"
+    "errors"
+    "net/http"
+    "github.com/gorilla/mux"
+    _ "github.com/lib/pq"
+    "encoding/json"
+    "log"
+    "strconv"
+    "time"
+)
+
+const (
+    RSVPInvited = "invited"
+    RSVPGoing = "going"
+    RSVPMaybe = "maybe"
+    RSVPDeclined = "declined"
+)
+
+const NumUpcomingEvents int = 50
+
+// An event is owned by the profile that created it and, optionally, by a
+// group. Group events are visible to anyone who can see the group's posts;
+// other events only to their owner and the people invited.
+type Event struct {
+    ID          int         `json:"id"`
+    OwnerUrl    string      `json:"ownerUrl"`
+    GroupUrl    string      `json:"groupUrl,omitempty"`
+    Title       string      `json:"title"`
+    Description string      `json:"description"`
+    Starts      time.Time   `json:"starts"`
+    Ends        *time.Time  `json:"ends,omitempty"`
+    Location    string      `json:"location"`
+    Going       int         `json:"going"`
+    Maybe       int         `json:"maybe"`
+    RSVP        string      `json:"rsvp,omitempty"`
+}
+
+type Attendee struct {
+    URL         string      `json:"url"`
+    FirstName   string      `json:"firstname"`
+    LastName    string      `json:"lastname"`
+    Status      string      `json:"status"`
+}
+
+func eventHandler(w http.ResponseWriter, r *http.Request) {
+    vars := mux.Vars(r)
+    action := vars["action"]
+    id := vars["id"]
+    member := vars["member"]
+
+    email, ok := checkAuthorisation(w, r)
+
+    if !ok {
+        return
+    }
+
+    user, err := profileUrlForEmail(r.Context(), email)
+
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusForbidden)
+        return
+    }
+
+    var result interface{}
+
+    switch action {
+    case "new", "modify":
+        var e Event
+        err = json.NewDecoder(r.Body).Decode(&e)
+
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusBadRequest)
+            return
+        }
+
+        if e.Title == "" || e.Starts.IsZero() || (e.Ends != nil && e.Ends.Before(e.Starts)) {
+            http.Error(w, "Events need a title and a start before their end", http.StatusBadRequest)
+            return
+        }
+
+        if action == "new" {
+            result, err = createEvent(r.Context(), user, e)
+        } else {
+            err = modifyEvent(r.Context(), id, user, e)
+        }
+    case "get":
+        result, err = loadEvent(r.Context(), id, user)
+    case "delete":
+        err = deleteEvent(r.Context(), id, user)
+    case "invite":
+        err = inviteToEvent(r.Context(), id, user, member)
+    case "rsvp":
+        var req struct {
+            Status string `json:"status"`
+        }
+
+        err = json.NewDecoder(r.Body).Decode(&req)
+
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusBadRequest)
+            return
+        }
+
+        err = rsvpEvent(r.Context(), id, user, req.Status)
+    case "attendees":
+        result, err = loadAttendees(r.Context(), id, user)
+    case "wall":
+        var before time.Time
+
+        if b := r.URL.Query().Get("before"); b != "" {
+            before, err = time.Parse(time.RFC3339Nano, b)
+
+            if err != nil {
+                http.Error(w, err.Error(), http.StatusBadRequest)
+                return
+            }
+        }
+
+        result, err = getEventPosts(r.Context(), id, user, before)
+    case "upcoming":
+        result, err = loadUpcomingEvents(r.Context(), user)
+    default:
+        http.NotFound(w, r)
+        return
+    }
+
+    if err != nil {
+        switch err {
+        case sql.ErrNoRows:
+            http.NotFound(w, r)
+        case errNotPermitted:
+            http.Error(w, err.Error(), http.StatusForbidden)
+        default:
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+            log.Println(err)
+        }
+        return
+    }
+
+    if result == nil {
+        w.WriteHeader(http.StatusOK)
+        return
+    }
+
+    err = json.NewEncoder(w).Encode(result)
+
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+    }
+}
+
+// Events $2 can see, for queries with the event as e: their own, ones they
+// were invited to, and those of public groups or groups they belong to.
+// Posts on an event's wall follow the same rule.
+const eventVisibleCondition = `(e.ownerurl = $2
+                OR EXISTS (SELECT *
+                            FROM attendee t
+                            WHERE t.eventid = e.id
+                            AND t.profileurl = $2)
+                OR EXISTS (SELECT *
+                            FROM groups g
+                            WHERE g.url = e.groupurl
+                            AND (g.privacy = 'public'
+                                OR EXISTS (SELECT *
+                                            FROM membership m
+                                            WHERE m.groupurl = g.url
+                                            AND m.profileurl = $2
+                                            AND m.status = 'member'))))`
+
+// Returns the user's RSVP to an event, or sql.ErrNoRows if they cannot see
+// it. manage reports whether the user may edit it: its owner, or a
+// moderator of its group.
+func eventAccess(ctx context.Context, id string, user string) (rsvp string, manage bool, err error) {
+    eventId, err := strconv.Atoi(id)
+
+    if err != nil {
+        return "", false, sql.ErrNoRows
+    }
+
+    query := `SELECT e.ownerurl, COALESCE(e.groupurl, ''), COALESCE(a.status, '')
+            FROM event e
+            LEFT JOIN attendee a ON a.eventid = e.id AND a.profileurl = $2
+            WHERE e.id = $1
+            AND ` + eventVisibleCondition + `;`
+
+    var owner, group string
+    err = db.QueryRowContext(ctx, query, eventId, user).Scan(&owner, &group, &rsvp)
+
+    if err != nil {
+        return "", false, err
+    }
+
+    if owner == user {
+        return rsvp, true, nil
+    }
+
+    if group == "" {
+        return rsvp, false, nil
+    }
+
+    _, role, status, err := membership(ctx, group, user)
+
+    if err == sql.ErrNoRows {
+        return rsvp, false, nil
+    }
+
+    if err != nil {
+        return "", false, err
+    }
+
+    manage = status == StatusMember && roleRank[role] >= roleRank[RoleModerator]
+
+    return rsvp, manage, nil
+}
+
+func createEvent(ctx context.Context, owner string, e Event) (*Event, error) {
+    ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+    defer cancel()
+
+    var group interface{}
+
+    if e.GroupUrl != "" {
+        err := requireRole(ctx, e.GroupUrl, owner, RoleModerator)
+
+        if err != nil {
+            return nil, err
+        }
+
+        group = e.GroupUrl
+    }
+
+    query := `INSERT INTO event (ownerurl, groupurl, title, description, starts, ends, location)
+            VALUES ($1, $2, $3, $4, $5, $6, $7)
+            RETURNING id;`
+
+    err := db.QueryRowContext(ctx, query, owner, group, e.Title, e.Description,
+            localTime(&e.Starts), localTime(e.Ends), e.Location).Scan(&e.ID)
+
+    if err != nil {
+        return nil, err
+    }
+
+    e.OwnerUrl = owner
+    e.Going, e.Maybe, e.RSVP = 0, 0, ""
+
+    return &e, nil
+}
+
+func loadEvent(ctx context.Context, id string, user string) (*Event, error) {
+    ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+    defer cancel()
+
+    rsvp, _, err := eventAccess(ctx, id, user)
+
+    if err != nil {
+        return nil, err
+    }
+
+    query := `SELECT id, ownerurl, COALESCE(groupurl, ''), title, description, starts, ends, location,
+                (SELECT COUNT(*) FROM attendee a WHERE a.eventid = event.id AND a.status = 'going'),
+                (SELECT COUNT(*) FROM attendee a WHERE a.eventid = event.id AND a.status = 'maybe')
+            FROM event
+            WHERE id = $1;`
+
+    e := Event{RSVP: rsvp}
+    err = db.QueryRowContext(ctx, query, id).Scan(&e.ID, &e.OwnerUrl, &e.GroupUrl, &e.Title,
+            &e.Description, &e.Starts, &e.Ends, &e.Location, &e.Going, &e.Maybe)
+
+    if err != nil {
+        return nil, err
+    }
+
+    return &e, nil
+}
+
+func modifyEvent(ctx context.Context, id string, user string, e Event) error {
+    ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+    defer cancel()
+
+    _, manage, err := eventAccess(ctx, id, user)
+
+    if err != nil {
+        return err
+    }
+
+    if !manage {
+        return errNotPermitted
+    }
+
+    query := `UPDATE event
+            SET title = $1, description = $2, starts = $3, ends = $4, location = $5
+            WHERE id = $6;`
+
+    _, err = db.ExecContext(ctx, query, e.Title, e.Description, localTime(&e.Starts),
+            localTime(e.Ends), e.Location, id)
+
+    return err
+}
+
+func deleteEvent(ctx context.Context, id string, user string) error {
+    ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+    defer cancel()
+
+    _, manage, err := eventAccess(ctx, id, user)
+
+    if err != nil {
+        return err
+    }
+
+    if !manage {
+        return errNotPermitted
+    }
+
+    tx, err := db.BeginTx(ctx, nil)
+
+    if err != nil {
+        return err
+    }
+
+    err = purgeEvents(ctx, tx, "id = $1", id)
+
+    if err != nil {
+        tx.Rollback()
+        return err
+    }
+
+    return tx.Commit()
+}
+
+// Removes the events matching cond, which refers to its argument as $1,
+// along with their invitations and wall posts.
+func purgeEvents(ctx context.Context, tx *sql.Tx, cond string, arg interface{}) error {
+    events := `SELECT id FROM event WHERE ` + cond
+
+    queries := []string{
+        `DELETE FROM reaction
+            WHERE (post = true
+                AND postid IN (SELECT id FROM post WHERE eventid IN (` + events + `)))
+            OR (post = false
+                AND commentid IN (SELECT c.id
+                                FROM comment c, post p
+                                WHERE c.postid = p.id
+                                AND p.eventid IN (` + events + `)));`,
+        `DELETE FROM comment
+            WHERE postid IN (SELECT id FROM post WHERE eventid IN (` + events + `));`,
+        `DELETE FROM post
+            WHERE eventid IN (` + events + `);`,
+        `DELETE FROM attendee
+            WHERE eventid IN (` + events + `);`,
+        `DELETE FROM event
+            WHERE ` + cond + `;`,
+    }
+
+    for _, query := range queries {
+        _, err := tx.ExecContext(ctx, query, arg)
+
+        if err != nil {
+            return err
+        }
+    }
+
+    return nil
+}
+
+// Anyone who can see an event can invite their own accepted connections.
+func inviteToEvent(ctx context.Context, id string, user string, invitee string) error {
+    ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+    defer cancel()
+
+    _, _, err := eventAccess(ctx, id, user)
+
+    if err != nil {
+        return err
+    }
+
+    query := `INSERT INTO attendee (eventid, profileurl, status, invitedby)
+            SELECT $1, $2, $3, $4
+            WHERE EXISTS (SELECT *
+                        FROM connection c
+                        WHERE c.accepted
+                        AND $2 IN(c.fromurl, c.tourl)
+                        AND $4 IN(c.fromurl, c.tourl))
+            ON CONFLICT DO NOTHING;`
+
+    res, err := db.ExecContext(ctx, query, id, invitee, RSVPInvited, user)
+
+    if err != nil {
+        return err
+    }
+
+    n, err := res.RowsAffected()
+
+    if err == nil && n == 0 && !attending(ctx, id, invitee) {
+        err = errNotPermitted
+    }
+
+    return err
+}
+
+func attending(ctx context.Context, id string, user string) bool {
+    query := `SELECT true
+            FROM attendee
+            WHERE eventid = $1
+            AND profileurl = $2;`
+
+    var exists bool
+    db.QueryRowContext(ctx, query, id, user).Scan(&exists)
+
+    return exists
+}
+
+func rsvpEvent(ctx context.Context, id string, user string, status string) error {
+    ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+    defer cancel()
+
+    if status != RSVPGoing && status != RSVPMaybe && status != RSVPDeclined {
+        return errors.New("Unknown RSVP " + status)
+    }
+
+    _, _, err := eventAccess(ctx, id, user)
+
+    if err != nil {
+        return err
+    }
+
+    query := `INSERT INTO attendee (eventid, profileurl, status)
+            VALUES ($1, $2, $3)
+            ON CONFLICT (eventid, profileurl) DO UPDATE
+            SET status = $3, timestamp = now();`
+
+    _, err = db.ExecContext(ctx, query, id, user, status)
+
+    return err
+}
+
+func loadAttendees(ctx context.Context, id string, user string) ([]Attendee, error) {
+    ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+    defer cancel()
+
+    _, _, err := eventAccess(ctx, id, user)
+
+    if err != nil {
+        return nil, err
+    }
+
+    query := `SELECT p.url, p.firstname, p.lastname, a.status
+            FROM attendee a, profile p
+            WHERE a.eventid = $1
+            AND p.url = a.profileurl
+            ORDER BY a.status, p.lastname, p.firstname;`
+
+    rows, err := db.QueryContext(ctx, query, id)
+
+    if err != nil {
+        return nil, err
+    }
+
+    defer rows.Close()
+
+    attendees := []Attendee{}
+
+    for rows.Next() {
+        var a Attendee
+        err = rows.Scan(&a.URL, &a.FirstName, &a.LastName, &a.Status)
+
+        if err != nil {
+            return nil, err
+        }
+
+        attendees = append(attendees, a)
+    }
+
+    return attendees, rows.Err()
+}
+
+func getEventPosts(ctx context.Context, id string, user string, before time.Time) ([]Post, error) {
+    ctx, cancel := context.WithTimeout(ctx, feedTimeout)
+    defer cancel()
+
+    _, _, err := eventAccess(ctx, id, user)
+
+    if err != nil {
+        return nil, err
+    }
+
+    if before.IsZero() {
+        before = time.Now()
+    }
+
+    query := `SELECT id, profileurl, authorurl, eventid, timestamp, content
+            FROM post
+            WHERE eventid = $1
+            AND deleted IS NULL
+            AND timestamp < $2
+            ORDER BY timestamp DESC
+            LIMIT $3;`
+
+    rows, err := db.QueryContext(ctx, query, id, before, PostsPerRequest)
+
+    if err != nil {
+        return nil, err
+    }
+
+    defer rows.Close()
+
+    results := []Post{}
+
+    for rows.Next() {
+        var post Post
+        err = rows.Scan(&post.ID, &post.ProfileUrl, &post.AuthorUrl, &post.EventId,
+                &post.Timestamp, &post.Content)
+
+        if err != nil {
+            return nil, err
+        }
+
+        results = append(results, post)
+    }
+
+    if err = rows.Err(); err != nil {
+        return nil, err
+    }
+
+    return results, decoratePosts(ctx, results, user)
+}
+
+// Events the user owns or has been invited to and not declined, that have
+// not yet finished, soonest first.
+func loadUpcomingEvents(ctx context.Context, user string) ([]Event, error) {
+    ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+    defer cancel()
+
+    query := `SELECT e.id, e.ownerurl, COALESCE(e.groupurl, ''), e.title, e.description,
+                e.starts, e.ends, e.location,
+                (SELECT COUNT(*) FROM attendee g WHERE g.eventid = e.id AND g.status = 'going'),
+                (SELECT COUNT(*) FROM attendee m WHERE m.eventid = e.id AND m.status = 'maybe'),
+                COALESCE(a.status, '')
+            FROM event e
+            LEFT JOIN attendee a ON a.eventid = e.id AND a.profileurl = $1
+            WHERE (e.ownerurl = $1 OR a.status IN('invited', 'going', 'maybe'))
+            AND COALESCE(e.ends, e.starts) > now()
+            ORDER BY e.starts
+            LIMIT $2;`
+
+    rows, err := db.QueryContext(ctx, query, user, NumUpcomingEvents)
+
+    if err != nil {
+        return nil, err
+    }
+
+    defer rows.Close()
+
+    events := []Event{}
+
+    for rows.Next() {
+        var e Event
+        err = rows.Scan(&e.ID, &e.OwnerUrl, &e.GroupUrl, &e.Title, &e.Description,
+                &e.Starts, &e.Ends, &e.Location, &e.Going, &e.Maybe, &e.RSVP)
+
+        if err != nil {
+            return nil, err
+        }
+
+        events = append(events, e)
+    }
+
+    return events, rows.Err()
+}
@@ -0,0 +1,501 @@
+package main
+
+import (
+    "archive/zip"
+    "context"
+    "crypto/rand"
+    "database/sql"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "github.com/gorilla/mux"
+    "io"
+    _ "github.com/lib/pq"
+    "log"
+    "net/http"
+    "os"
+    "path/filepath"
+    "time"
+)
+
+const ExportLifetime = 7 * 24 * time.Hour
+const exportTimeout = 5 * time.Minute
+
+// Accounts may ask for one export an hour. An export still pending well
+// after any build of it would have timed out is taken to have died with
+// its server.
+const ExportInterval = time.Hour
+const exportStuck = 3 * exportTimeout
+
+var errExportLimited = errors.New("An export is already in progress or was requested recently")
+
+var exportDir = "exports"
+
+type Export struct {
+    Token       string      `json:"token"`
+    Requested   time.Time   `json:"requested"`
+    Completed   *time.Time  `json:"completed,omitempty"`
+    Expires     *time.Time  `json:"expires,omitempty"`
+    Failed      bool        `json:"failed"`
+    Download    string      `json:"download,omitempty"`
+}
+
+// The files making up an export archive and the queries that fill them.
+// Each query takes the account email as $1. There is no media storage yet,
+// so an archive holds only these tables.
+var exportFiles = []struct {
+    name    string
+    query   string
+}{
+    {"account.json", `SELECT email, dob
+            FROM account
+            WHERE email = $1;`},
+    {"profile.json", `SELECT url, firstname, lastname, email, dob, bio
+            FROM profile
+            WHERE email = $1;`},
+    {"posts_authored.json", `SELECT id, profileurl, authorurl, timestamp, content, sharedid
+            FROM post
+            WHERE authorurl IN (SELECT url FROM profile WHERE email = $1)
+            ORDER BY timestamp;`},
+    {"posts_received.json", `SELECT id, profileurl, authorurl, timestamp, content
+            FROM post
+            WHERE profileurl IN (SELECT url FROM profile WHERE email = $1)
+            AND authorurl NOT IN (SELECT url FROM profile WHERE email = $1)
+            ORDER BY timestamp;`},
+    {"comments.json", `SELECT id, postid, authorurl, timestamp, content
+            FROM comment
+            WHERE authorurl IN (SELECT url FROM profile WHERE email = $1)
+            ORDER BY timestamp;`},
+    {"reactions.json", `SELECT *
+            FROM reaction
+            WHERE authorurl IN (SELECT url FROM profile WHERE email = $1);`},
+    {"connections.json", `SELECT *
+            FROM connection c
+            WHERE EXISTS (SELECT *
+                        FROM profile
+                        WHERE email = $1
+                        AND url IN(c.fromurl, c.tourl));`},
+    {"follows.json", `SELECT follower, followed, approved, timestamp
+            FROM follow f
+            WHERE EXISTS (SELECT *
+                        FROM profile
+                        WHERE email = $1
+                        AND url IN(f.follower, f.followed));`},
+    {"groups.json", `SELECT groupurl, role, status, timestamp
+            FROM membership
+            WHERE profileurl IN (SELECT url FROM profile WHERE email = $1);`},
+    {"events.json", `SELECT e.id, e.title, e.starts, e.ends, e.location, a.status
+            FROM event e, attendee a
+            WHERE a.eventid = e.id
+            AND a.profileurl IN (SELECT url FROM profile WHERE email = $1);`},
+    {"searches.json", `SELECT resultUrl, timestamp
+            FROM search
+            WHERE acctEmail = $1
+            ORDER BY timestamp;`},
+    {"drafts.json", `SELECT profileurl, content, groupurl, eventid, publishat, updated
+            FROM draft
+            WHERE authorurl IN (SELECT url FROM profile WHERE email = $1)
+            ORDER BY updated;`},
+    {"stories.json", `SELECT content, image, created, expires
+            FROM story
+            WHERE profileurl IN (SELECT url FROM profile WHERE email = $1)
+            ORDER BY created;`},
+    {"notifications.json", `SELECT kind, actorurl, postid, commentid, created, read
+            FROM notification
+            WHERE profileurl IN (SELECT url FROM profile WHERE email = $1)
+            ORDER BY created;`},
+}
+
+func exportHandler(w http.ResponseWriter, r *http.Request) {
+    vars := mux.Vars(r)
+    action := vars["action"]
+
+    email, ok := checkAuthorisation(w, r)
+
+    if !ok {
+        return
+    }
+
+    switch action {
+    case "request":
+        token, err := createExport(r.Context(), email)
+
+        if err == errExportLimited {
+            http.Error(w, err.Error(), http.StatusTooManyRequests)
+            return
+        }
+
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+            return
+        }
+
+        // The export job picks it up
+        w.WriteHeader(http.StatusAccepted)
+        err = json.NewEncoder(w).Encode(struct {
+            Token string `json:"token"`
+        }{
+            Token: token,
+        })
+
+        if err != nil {
+            log.Println(err)
+        }
+    case "status":
+        exports, err := loadExports(r.Context(), email)
+
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+            return
+        }
+
+        err = json.NewEncoder(w).Encode(exports)
+
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+        }
+    default:
+        http.NotFound(w, r)
+    }
+}
+
+func exportDownloadHandler(w http.ResponseWriter, r *http.Request) {
+    vars := mux.Vars(r)
+    token := vars["token"]
+
+    email, ok := checkAuthorisation(w, r)
+
+    if !ok {
+        return
+    }
+
+    path, err := exportPath(r.Context(), email, token)
+
+    if err != nil {
+        if err == sql.ErrNoRows {
+            http.NotFound(w, r)
+        } else {
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+        }
+        return
+    }
+
+    w.Header().Set("Content-Disposition", "attachment; filename=netwrk-export.zip")
+    http.ServeFile(w, r, path)
+}
+
+func newToken() (string, error) {
+    b := make([]byte, 16)
+    _, err := rand.Read(b)
+
+    if err != nil {
+        return "", err
+    }
+
+    return hex.EncodeToString(b), nil
+}
+
+func createExport(ctx context.Context, email string) (string, error) {
+    ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+    defer cancel()
+
+    token, err := newToken()
+
+    if err != nil {
+        return "", err
+    }
+
+    // The unique index on pending exports settles two requests racing
+    query := `INSERT INTO export (acctEmail, token)
+            SELECT $1, $2
+            WHERE NOT EXISTS (SELECT *
+                            FROM export
+                            WHERE acctEmail = $1
+                            AND NOT failed
+                            AND requested > now() - $3 * interval '1 second')
+            ON CONFLICT (acctEmail) WHERE completed IS NULL DO NOTHING;`
+
+    res, err := db.ExecContext(ctx, query, email, token, ExportInterval.Seconds())
+
+    if err != nil {
+        return "", err
+    }
+
+    if n, _ := res.RowsAffected(); n == 0 {
+        return "", errExportLimited
+    }
+
+    return token, nil
+}
+
+// Builds pending exports one at a time until none are left. Each is claimed
+// first, so servers running this job share the work.
+func runExports(ctx context.Context) error {
+    for ctx.Err() == nil {
+        qctx, cancel := context.WithTimeout(ctx, queryTimeout)
+
+        query := `UPDATE export
+                SET started = now()
+                WHERE token = (SELECT token
+                                FROM export
+                                WHERE completed IS NULL
+                                AND started IS NULL
+                                ORDER BY requested
+                                LIMIT 1
+                                FOR UPDATE SKIP LOCKED)
+                RETURNING token, acctEmail;`
+
+        var token, email string
+        err := db.QueryRowContext(qctx, query).Scan(&token, &email)
+        cancel()
+
+        if err == sql.ErrNoRows {
+            return nil
+        }
+
+        if err != nil {
+            return err
+        }
+
+        buildExport(ctx, token, email)
+    }
+
+    return nil
+}
+
+func loadExports(ctx context.Context, email string) ([]Export, error) {
+    ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+    defer cancel()
+
+    query := `SELECT token, requested, completed, expires, failed
+            FROM export
+            WHERE acctEmail = $1
+            AND (expires IS NULL OR expires > now())
+            ORDER BY requested DESC;`
+
+    rows, err := db.QueryContext(ctx, query, email)
+
+    if err != nil {
+        return nil, err
+    }
+
+    defer rows.Close()
+
+    var exports []Export
+
+    for rows.Next() {
+        var e Export
+        err = rows.Scan(&e.Token, &e.Requested, &e.Completed, &e.Expires, &e.Failed)
+
+        if err != nil {
+            return nil, err
+        }
+
+        if e.Completed != nil && !e.Failed {
+            e.Download = "/export/download/" + e.Token
+        }
+
+        exports = append(exports, e)
+    }
+
+    return exports, rows.Err()
+}
+
+func exportPath(ctx context.Context, email string, token string) (string, error) {
+    ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+    defer cancel()
+
+    query := `SELECT path
+            FROM export
+            WHERE acctEmail = $1
+            AND token = $2
+            AND NOT failed
+            AND completed IS NOT NULL
+            AND expires > now();`
+
+    var path string
+    err := db.QueryRowContext(ctx, query, email, token).Scan(&path)
+
+    return path, err
+}
+
+func buildExport(ctx context.Context, token string, email string) {
+    ctx, cancel := context.WithTimeout(ctx, exportTimeout)
+    defer cancel()
+
+    path := filepath.Join(exportDir, token + ".zip")
+    err := writeExport(ctx, path, email)
+
+    // Record the outcome even if generation ran out of time
+    ctx, cancel = context.WithTimeout(context.Background(), queryTimeout)
+    defer cancel()
+
+    if err != nil {
+        log.Println("Export " + token + " failed: " + err.Error())
+        os.Remove(path)
+
+        query := `UPDATE export
+                SET completed = now(), expires = $1, failed = true
+                WHERE token = $2;`
+
+        _, err = db.ExecContext(ctx, query, time.Now().Add(ExportLifetime), token)
+    } else {
+        query := `UPDATE export
+                SET completed = now(), expires = $1, path = $2
+                WHERE token = $3;`
+
+        _, err = db.ExecContext(ctx, query, time.Now().Add(ExportLifetime), path, token)
+    }
+
+    if err != nil {
+        log.Println(err)
+    }
+}
+
+func writeExport(ctx context.Context, path string, email string) error {
+    err := os.MkdirAll(exportDir, 0700)
+
+    if err != nil {
+        return err
+    }
+
+    f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+
+    if err != nil {
+        return err
+    }
+
+    err = writeArchive(ctx, f, email)
+    closeErr := f.Close()
+
+    if err == nil {
+        err = closeErr
+    }
+
+    return err
+}
+
+func writeArchive(ctx context.Context, w io.Writer, email string) error {
+    // Read everything from one snapshot so the files agree with each other
+    tx, err := db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+
+    if err != nil {
+        return err
+    }
+
+    defer tx.Rollback()
+
+    archive := zip.NewWriter(w)
+
+    for _, file := range exportFiles {
+        records, err := exportRecords(ctx, tx, file.query, email)
+
+        if err != nil {
+            return err
+        }
+
+        out, err := archive.Create(file.name)
+
+        if err != nil {
+            return err
+        }
+
+        enc := json.NewEncoder(out)
+        enc.SetIndent("", "  ")
+        err = enc.Encode(records)
+
+        if err != nil {
+            return err
+        }
+    }
+
+    return archive.Close()
+}
+
+// Reads every row of a query as a column name to value map, so the export
+// follows the tables without a struct per table.
+func exportRecords(ctx context.Context, tx *sql.Tx, query string, email string) ([]map[string]interface{}, error) {
+    rows, err := tx.QueryContext(ctx, query, email)
+
+    if err != nil {
+        return nil, err
+    }
+
+    defer rows.Close()
+
+    cols, err := rows.Columns()
+
+    if err != nil {
+        return nil, err
+    }
+
+    records := []map[string]interface{}{}
+
+    for rows.Next() {
+        values := make([]interface{}, len(cols))
+        ptrs := make([]interface{}, len(cols))
+
+        for i := range values {
+            ptrs[i] = &values[i]
+        }
+
+        err = rows.Scan(ptrs...)
+
+        if err != nil {
+            return nil, err
+        }
+
+        record := make(map[string]interface{}, len(cols))
+
+        for i, col := range cols {
+            if b, ok := values[i].([]byte); ok {
+                record[col] = string(b)
+            } else {
+                record[col] = values[i]
+            }
+        }
+
+        records = append(records, record)
+    }
+
+    return records, rows.Err()
+}
+
+// Removes expired exports, and ones stuck pending, along with their files.
+// A stuck export's partial file is at the path it was being written to.
+func purgeExpiredExports(ctx context.Context) error {
+    ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+    defer cancel()
+
+    query := `DELETE FROM export
+            WHERE expires < now()
+            OR (completed IS NULL
+                AND started < now() - $1 * interval '1 second')
+            RETURNING token, path;`
+
+    rows, err := db.QueryContext(ctx, query, exportStuck.Seconds())
+
+    if err != nil {
+        return err
+    }
+
+    defer rows.Close()
+
+    for rows.Next() {
+        var token string
+        var path sql.NullString
+        err = rows.Scan(&token, &path)
+
+        if err != nil {
+            return err
+        }
+
+        if !path.Valid {
+            path.String = filepath.Join(exportDir, token + ".zip")
+        }
+
+        os.Remove(path.String)
+    }
+
+    return rows.Err()
+}
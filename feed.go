@@ -1,6 +1,7 @@
 package main
 
 import(
+    "context"
     "net/http"
     "database/sql"
     _ "github.com/lib/pq"
@@ -15,6 +16,9 @@ type FeedRequest struct {
     Identifier  string      `json:"identifier"`
     MainFeed    bool        `json:"mainFeed"`
     Before      time.Time   `json:"before"`
+    Relationship string     `json:"relationship"`
+    Ranked      bool        `json:"ranked"`
+    Page        int         `json:"page"`
 }
 
 func feedHandler(w http.ResponseWriter, r *http.Request) {
@@ -34,14 +38,54 @@ func feedHandler(w http.ResponseWriter, r *http.Request) {
         return
     }
 
-    var results []Post
+    var (
+        results []Post
+        viewer string
+    )
+
+    // The main feed is chronological unless ranked is asked for, when Page
+    // steps through the ranked posts and Before stays fixed. Pages after the
+    // first need Before, or the ranking would shift under them.
+    if req.MainFeed && req.Ranked && req.Page > 0 && req.Before.IsZero() {
+        http.Error(w, "Ranked pages after the first need before", http.StatusBadRequest)
+        return
+    }
 
     if req.MainFeed {
-        results, err = getFriendPosts(req.Identifier, req.Before)
+        // It's the signed-in user's own feed, whatever Identifier says
+        email, ok := checkAuthorisation(w, r)
+
+        if !ok {
+            return
+        }
+
+        viewer, err = profileUrlForEmail(r.Context(), email)
+
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusForbidden)
+            return
+        }
+
+        if req.Ranked {
+            results, err = getRankedPosts(r.Context(), req, viewer)
+        } else {
+            results, err = getFriendPosts(r.Context(), viewer, req.Before, req.Relationship,
+                    PostsPerRequest)
+        }
     } else {
-        results, err = getProfilePosts(req.Identifier, req.Before)
+        var ok bool
+        viewer, ok = optionalViewer(w, r)
+
+        if !ok {
+            return
+        }
+
+        results, err = getProfilePosts(r.Context(), req.Identifier, viewer, req.Before)
     }
 
+    if err == nil {
+        err = decoratePosts(r.Context(), results, viewer)
+    }
 
     if err != nil {
         http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -59,162 +103,143 @@ func feedHandler(w http.ResponseWriter, r *http.Request) {
     //log.Println(results));
 }
 
-func getFriendPosts(userEmail string, before time.Time) ([]Post, error) {
-    log.Println("getFriendPosts");
-    log.Println(before);
-    var (
-        query string
-        rows *sql.Rows
-        err error
-    )
+// Posts by or on the profiles of the user's connections, posts by profiles
+// they follow and posts in groups they belong to, newest first. relType
+// limits them to connections of that relationship type, leaving out follows
+// and groups, when set. The unfiltered feed is read from the user's
+// timeline where it can be.
+func getFriendPosts(ctx context.Context, user string, before time.Time, relType string, limit int) ([]Post, error) {
+    ctx, cancel := context.WithTimeout(ctx, feedTimeout)
+    defer cancel()
 
     if before.IsZero() {
-        query = `SELECT p.id, p.profileurl, p.authorurl, p.timestamp, p.content
-                FROM post p, profile q
-                WHERE q.email = '$1' 
-                AND EXISTS (SELECT *
-                            FROM connection c
-                            WHERE q.url IN(c.fromurl, c.tourl)
-                            AND (p.profileurl IN(c.fromurl, c.tourl)
-                                OR p.authorurl IN(c.fromurl, c.tourl)))
-                ORDER BY p.timestamp DESC
-                LIMIT $2;`
-        rows, err = db.Query(query, userEmail, PostsPerRequest)
-    } else {
-        query = `SELECT p.id, p.profileurl, p.authorurl, p.timestamp, p.content
-                FROM post p, profile q
-                WHERE q.email = $1 
-                AND p.timestamp < $2
-                AND EXISTS (SELECT *
-                            FROM connection c
-                            WHERE q.url IN(c.fromurl, c.tourl)
-                            AND (p.profileurl IN(c.fromurl, c.tourl)
-                                OR p.authorurl IN(c.fromurl, c.tourl)))
-                ORDER BY p.timestamp DESC
-                LIMIT $3;`
-        rows, err = db.Query(query, userEmail, before, PostsPerRequest)
-    }
-
-    if err != nil {
-        return nil, err
+        before = time.Now()
     }
 
-    var results []Post
+    if relType == "" {
+        posts, ok, err := readTimeline(ctx, user, before, limit)
 
-    for rows.Next() {
-        var post Post
-        err = rows.Scan(&post.ID, &post.ProfileUrl, &post.AuthorUrl, &post.Timestamp, &post.Content)
-        if err != nil {
-            return nil, err
+        if err != nil || ok {
+            return posts, err
         }
+    }
 
-        if !containsPost(results, post) {
-            results = append(results, post)
-        }
-    } 
+    return queryFriendPosts(ctx, user, before, relType, limit, false)
+}
+
+// The feed straight from the post table. The user's connections, follows and
+// groups are looked up once rather than per post, which lets the planner
+// either walk the timestamp index or the per-profile indexes. unfanned
+// limits it to posts that weren't copied into timelines.
+func queryFriendPosts(ctx context.Context, user string, before time.Time, relType string, limit int, unfanned bool) ([]Post, error) {
+    query := `WITH friends AS (SELECT $1::text AS url WHERE $4 = ''
+                    UNION SELECT c.tourl
+                        FROM connection c
+                        WHERE c.fromurl = $1
+                        AND c.accepted
+                        AND ($4 = '' OR c.type = $4)
+                    UNION SELECT c.fromurl
+                        FROM connection c
+                        WHERE c.tourl = $1
+                        AND c.accepted
+                        AND ($4 = '' OR c.type = $4)),
+                followed AS (SELECT f.followed AS url
+                    FROM follow f
+                    WHERE f.follower = $1
+                    AND f.approved
+                    AND $4 = ''),
+                joined AS (SELECT m.groupurl AS url
+                    FROM membership m
+                    WHERE m.profileurl = $1
+                    AND m.status = 'member'
+                    AND $4 = '')
+            SELECT p.id, p.profileurl, p.authorurl, p.timestamp, p.content
+            FROM post p
+            WHERE p.timestamp < $2
+            AND p.deleted IS NULL
+            AND (NOT $5 OR NOT p.fannedout)
+            AND ((p.groupurl IS NULL
+                    AND p.eventid IS NULL
+                    AND (p.profileurl IN (SELECT url FROM friends)
+                        OR p.authorurl IN (SELECT url FROM friends)
+                        OR p.authorurl IN (SELECT url FROM followed)))
+                OR p.groupurl IN (SELECT url FROM joined))
+            ORDER BY p.timestamp DESC
+            LIMIT $3;`
+
+    rows, err := db.QueryContext(ctx, query, user, before, limit, relType, unfanned)
 
     if err != nil {
         return nil, err
     }
-/*
-    if len(results) < PostsPerRequest {
-        if before.IsZero() {
-            query = `SELECT p.id, p.profileurl, p.authorurl, p.timestamp, p.content
-                    FROM post p, profile q
-                    WHERE q.email = $1
-                    AND EXISTS (SELECT * 
-                                FROM connection c
-                                WHERE p.profileurl IN(c.fromurl, c.tourl))
-                    ORDER BY p.timestamp DESC
-                    LIMIT $2;`
-            rows, err = db.Query(query, userEmail, PostsPerRequest - len(results))
-        } else {
-            query = `SELECT p.id, p.profileurl, p.authorurl, p.timestamp, p.content
-                    FROM post p, profile q
-                    WHERE q.email = $1
-                    AND p.timestamp < $2
-                    AND EXISTS (SELECT * 
-                                FROM connection c
-                                WHERE p.profileurl IN(c.fromurl, c.tourl))
-                    ORDER BY p.timestamp DESC
-                    LIMIT $3;`
-            rows, err = db.Query(query, userEmail, before, PostsPerRequest - len(results))
-        }
 
-        if err != nil {
-            return nil, err
-        }
+    return scanPosts(rows)
+}
 
-        for rows.Next() {
-            var post Post
-            err = rows.Scan(&post.ID, &post.ProfileUrl, &post.AuthorUrl, &post.Timestamp, &post.Content)
-            if err != nil {
-                return nil, err
-            }
+// Reads id, profileurl, authorurl, timestamp and content rows into posts,
+// closing rows.
+func scanPosts(rows *sql.Rows) ([]Post, error) {
+    defer rows.Close()
 
-            if !containsPost(results, post) {
-                results = append(results, post)
-            }
-        }
+    var results []Post
+
+    for rows.Next() {
+        var post Post
+        err := rows.Scan(&post.ID, &post.ProfileUrl, &post.AuthorUrl, &post.Timestamp, &post.Content)
 
         if err != nil {
             return nil, err
         }
-    }
-*/
-    return results, nil
-}
 
-func containsPost(list []Post, post Post) bool {
-
-    for _, item := range list {
-        if item.ID == post.ID {
-            return true
-        }
+        results = append(results, post)
     }
 
-    return false
+    return results, rows.Err()
 }
 
-func getProfilePosts(profileUrl string, before time.Time) ([]Post, error) {
-    var (
-        query string
-        rows *sql.Rows
-        err error
-    )
+// Posts on a profile, newest first, as seen by viewer. A private profile's
+// posts are only shown to it, its connections and approved followers, and
+// blocks either way hide everything.
+func getProfilePosts(ctx context.Context, profileUrl string, viewer string, before time.Time) ([]Post, error) {
+    ctx, cancel := context.WithTimeout(ctx, feedTimeout)
+    defer cancel()
 
     if before.IsZero() {
-        query = `SELECT id, profileurl, authorurl, timestamp, content
-                FROM post
-                WHERE profileurl = $1 
-                ORDER BY timestamp DESC
-                LIMIT $2;`
-        rows, err = db.Query(query, profileUrl, PostsPerRequest)
-    } else {
-        query = `SELECT id, profileurl, authorurl, timestamp, content
-                FROM post
-                WHERE profileurl = $1 
-                AND timestamp < $2
-                ORDER BY timestamp DESC
-                LIMIT $3;`
-
-        rows, err = db.Query(query, profileUrl, before, PostsPerRequest)
-    }
-    if err != nil {
-        return nil, err
+        before = time.Now()
     }
 
-    var results []Post
-
-    for rows.Next() {
-        var post Post
-        err = rows.Scan(&post.ID, &(post.ProfileUrl), &(post.AuthorUrl), &(post.Timestamp), &(post.Content))
-        results = append(results, post)
-    }
+    query := `SELECT p.id, p.profileurl, p.authorurl, p.timestamp, p.content
+            FROM post p, profile o
+            WHERE p.profileurl = $1
+            AND o.url = p.profileurl
+            AND p.groupurl IS NULL
+            AND p.eventid IS NULL
+            AND p.deleted IS NULL
+            AND p.timestamp < $3
+            AND ($2 = o.url
+                OR NOT o.private
+                OR EXISTS (SELECT *
+                            FROM connection c
+                            WHERE c.accepted
+                            AND $2 IN(c.fromurl, c.tourl)
+                            AND o.url IN(c.fromurl, c.tourl))
+                OR EXISTS (SELECT *
+                            FROM follow f
+                            WHERE f.follower = $2
+                            AND f.approved
+                            AND f.followed = o.url))
+            AND NOT EXISTS (SELECT *
+                            FROM block b
+                            WHERE (b.blocker = $2 AND b.blocked IN(p.authorurl, p.profileurl))
+                            OR (b.blocked = $2 AND b.blocker IN(p.authorurl, p.profileurl)))
+            ORDER BY p.timestamp DESC
+            LIMIT $4;`
+
+    rows, err := db.QueryContext(ctx, query, profileUrl, viewer, before, PostsPerRequest)
 
     if err != nil {
         return nil, err
     }
 
-    return results, nil
+    return scanPosts(rows)
 }
@@ -0,0 +1,198 @@
+package main
+
+import (
+    "context"
+    "net/http"
+    "github.com/gorilla/mux"
+    _ "github.com/lib/pq"
+    "encoding/json"
+    "time"
+)
+
+// A one-directional subscription to a profile's posts. Following a private
+// profile needs the profile's approval; public profiles are followed
+// straight away.
+type Follow struct {
+    URL         string      `json:"url"`
+    FirstName   string      `json:"firstname"`
+    LastName    string      `json:"lastname"`
+    Approved    bool        `json:"approved"`
+    Since       time.Time   `json:"since"`
+}
+
+// p1 is the profile acting: the follower for follow and unfollow, and the
+// followed profile for approve and reject.
+func followHandler(w http.ResponseWriter, r *http.Request) {
+    vars := mux.Vars(r)
+    action := vars["action"]
+    p1 := vars["p1"]
+    p2 := vars["p2"]
+
+    // p1 acts in every case: it follows or unfollows p2, or approves or
+    // rejects p2 following it
+    if !checkProfileOwner(w, r, p1) {
+        return
+    }
+
+    var err error
+
+    switch action {
+    case "follow":
+        err = followProfile(r.Context(), p1, p2)
+    case "unfollow", "reject":
+        follower, followed := p1, p2
+
+        if action == "reject" {
+            follower, followed = p2, p1
+        }
+
+        err = unfollowProfile(r.Context(), follower, followed)
+    case "approve":
+        err = approveFollower(r.Context(), p1, p2)
+    default:
+        http.NotFound(w, r)
+        return
+    }
+
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    switch action {
+    case "follow", "unfollow":
+        invalidateTimelines(r.Context(), p1)
+    case "approve", "reject":
+        invalidateTimelines(r.Context(), p2)
+    }
+
+    // Follower counts
+    invalidateProfiles(p1, p2)
+
+    w.WriteHeader(http.StatusOK)
+}
+
+// Lists a profile's followers or the profiles it follows. Followers awaiting
+// approval are listed instead with ?pending=true.
+func followListHandler(w http.ResponseWriter, r *http.Request) {
+    vars := mux.Vars(r)
+    list := vars["list"]
+    url := vars["url"]
+
+    pending := r.URL.Query().Get("pending") == "true"
+
+    if list != "followers" && list != "following" {
+        http.NotFound(w, r)
+        return
+    }
+
+    // Only the profile itself sees who is waiting on it
+    if pending && !checkProfileOwner(w, r, url) {
+        return
+    }
+
+    follows, err := loadFollows(r.Context(), url, list == "followers", !pending)
+
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    err = json.NewEncoder(w).Encode(follows)
+
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+    }
+}
+
+func followProfile(ctx context.Context, follower string, followed string) error {
+    ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+    defer cancel()
+
+    query := `INSERT INTO follow (follower, followed, approved)
+            SELECT $1, p.url, NOT p.private
+            FROM profile p
+            WHERE p.url = $2
+            AND NOT EXISTS (SELECT *
+                            FROM block b
+                            WHERE (b.blocker = $1 AND b.blocked = $2)
+                            OR (b.blocker = $2 AND b.blocked = $1))
+            ON CONFLICT DO NOTHING;`
+
+    _, err := db.ExecContext(ctx, query, follower, followed)
+
+    return err
+}
+
+func unfollowProfile(ctx context.Context, follower string, followed string) error {
+    ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+    defer cancel()
+
+    query := `DELETE FROM follow
+            WHERE follower = $1
+            AND followed = $2;`
+
+    _, err := db.ExecContext(ctx, query, follower, followed)
+
+    return err
+}
+
+func approveFollower(ctx context.Context, followed string, follower string) error {
+    ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+    defer cancel()
+
+    query := `UPDATE follow
+            SET approved = true, timestamp = now()
+            WHERE follower = $1
+            AND followed = $2;`
+
+    _, err := db.ExecContext(ctx, query, follower, followed)
+
+    return err
+}
+
+func loadFollows(ctx context.Context, url string, followers bool, approved bool) ([]Follow, error) {
+    ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+    defer cancel()
+
+    var query string
+
+    if followers {
+        query = `SELECT p.url, p.firstname, p.lastname, f.approved, f.timestamp
+                FROM follow f, profile p
+                WHERE f.followed = $1
+                AND p.url = f.follower
+                AND f.approved = $2
+                ORDER BY f.timestamp DESC;`
+    } else {
+        query = `SELECT p.url, p.firstname, p.lastname, f.approved, f.timestamp
+                FROM follow f, profile p
+                WHERE f.follower = $1
+                AND p.url = f.followed
+                AND f.approved = $2
+                ORDER BY f.timestamp DESC;`
+    }
+
+    rows, err := db.QueryContext(ctx, query, url, approved)
+
+    if err != nil {
+        return nil, err
+    }
+
+    defer rows.Close()
+
+    follows := []Follow{}
+
+    for rows.Next() {
+        var f Follow
+        err = rows.Scan(&f.URL, &f.FirstName, &f.LastName, &f.Approved, &f.Since)
+
+        if err != nil {
+            return nil, err
+        }
+
+        follows = append(follows, f)
+    }
+
+    return follows, rows.Err()
+}
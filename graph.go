@@ -0,0 +1,142 @@
+package main
+
+import (
+    "context"
+    "database/sql"
+    "github.com/lib/pq"
+    "sort"
+)
+
+// Separation is how far apart two profiles are through accepted
+// connections: 0 for the same profile, 1 for direct connections, 2 for
+// friends of friends and 3 for one step further. Found is false, with an
+// empty path, when they are further apart than that.
+type Separation struct {
+    Found       bool        `json:"found"`
+    Degree      int         `json:"degree"`
+    Path        []string    `json:"path"`
+}
+
+// Searches outward from both ends at once, so only the two friend lists
+// and, for the third degree, a single indexed lookup of a connection
+// between them are needed rather than a walk of the whole graph.
+func separation(ctx context.Context, p1 string, p2 string) (*Separation, error) {
+    ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+    defer cancel()
+
+    if p1 == p2 {
+        return &Separation{true, 0, []string{p1}}, nil
+    }
+
+    friends1, err := friendUrls(ctx, p1)
+
+    if err != nil {
+        return nil, err
+    }
+
+    if friends1[p2] {
+        return &Separation{true, 1, []string{p1, p2}}, nil
+    }
+
+    friends2, err := friendUrls(ctx, p2)
+
+    if err != nil {
+        return nil, err
+    }
+
+    if mutual := intersect(friends1, friends2); len(mutual) > 0 {
+        return &Separation{true, 2, []string{p1, mutual[0], p2}}, nil
+    }
+
+    query := `SELECT CASE WHEN fromurl = ANY($1) THEN fromurl ELSE tourl END,
+                CASE WHEN fromurl = ANY($1) THEN tourl ELSE fromurl END
+            FROM connection
+            WHERE accepted
+            AND ((fromurl = ANY($1) AND tourl = ANY($2))
+                OR (fromurl = ANY($2) AND tourl = ANY($1)))
+            ORDER BY 1, 2
+            LIMIT 1;`
+
+    var a, b string
+    err = db.QueryRowContext(ctx, query, pq.Array(keys(friends1)), pq.Array(keys(friends2))).Scan(&a, &b)
+
+    if err == nil {
+        return &Separation{true, 3, []string{p1, a, b, p2}}, nil
+    }
+
+    if err == sql.ErrNoRows {
+        return &Separation{false, 0, []string{}}, nil
+    }
+
+    return nil, err
+}
+
+func mutualConnections(ctx context.Context, p1 string, p2 string) ([]Result, error) {
+    ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+    defer cancel()
+
+    friends1, err := friendUrls(ctx, p1)
+
+    if err != nil {
+        return nil, err
+    }
+
+    friends2, err := friendUrls(ctx, p2)
+
+    if err != nil {
+        return nil, err
+    }
+
+    query := `SELECT url, firstname, lastname
+            FROM profile
+            WHERE url = ANY($1)
+            ORDER BY lastname, firstname;`
+
+    rows, err := db.QueryContext(ctx, query, pq.Array(intersect(friends1, friends2)))
+
+    if err != nil {
+        return nil, err
+    }
+
+    defer rows.Close()
+
+    results := []Result{}
+
+    for rows.Next() {
+        var res Result
+        err = rows.Scan(&res.URL, &res.FirstName, &res.LastName)
+
+        if err != nil {
+            return nil, err
+        }
+
+        results = append(results, res)
+    }
+
+    return results, rows.Err()
+}
+
+// Sorted so paths and mutual lists are stable between requests.
+func intersect(a map[string]bool, b map[string]bool) []string {
+    var both []string
+
+    for url := range a {
+        if b[url] {
+            both = append(both, url)
+        }
+    }
+
+    sort.Strings(both)
+
+    return both
+}
+
+func keys(set map[string]bool) []string {
+    list := make([]string, 0, len(set))
+
+    for url := range set {
+        list = append(list, url)
+    }
+
+    return list
+}
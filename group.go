@@ -0,0 +1,692 @@
+package main
+
+import (
+    "context"
+    "database/sql"
+    "errors"
+    "net/http"
+    "github.com/gorilla/mux"
+    _ "github.com/lib/pq"
+    "encoding/json"
+    "io"
+    "log"
+    "time"
+)
+
+// Public groups can be seen and joined by anyone. Closed groups can be
+// seen by anyone but joining needs a moderator's approval, and their posts
+// are for members only. Secret groups are invisible to non-members and are
+// joined by invitation.
+const (
+    GroupPublic = "public"
+    GroupClosed = "closed"
+    GroupSecret = "secret"
+)
+
+const (
+    RoleMember = "member"
+    RoleModerator = "moderator"
+    RoleAdmin = "admin"
+)
+
+// Membership statuses; only StatusMember grants access.
+const (
+    StatusMember = "member"
+    StatusRequested = "requested"
+    StatusInvited = "invited"
+)
+
+var roleRank = map[string]int{
+    RoleMember: 0,
+    RoleModerator: 1,
+    RoleAdmin: 2,
+}
+
+var errNotPermitted = errors.New("Not permitted")
+
+type Group struct {
+    URL         string      `json:"url"`
+    Name        string      `json:"name"`
+    Description string      `json:"description"`
+    Privacy     string      `json:"privacy"`
+    Created     time.Time   `json:"created"`
+    Members     int         `json:"members"`
+    Role        string      `json:"role,omitempty"`
+    Status      string      `json:"status,omitempty"`
+}
+
+type Member struct {
+    URL         string      `json:"url"`
+    FirstName   string      `json:"firstname"`
+    LastName    string      `json:"lastname"`
+    Role        string      `json:"role"`
+    Status      string      `json:"status"`
+}
+
+func groupHandler(w http.ResponseWriter, r *http.Request) {
+    vars := mux.Vars(r)
+    action := vars["action"]
+    url := vars["url"]
+    member := vars["member"]
+
+    email, ok := checkAuthorisation(w, r)
+
+    if !ok {
+        return
+    }
+
+    user, err := profileUrlForEmail(r.Context(), email)
+
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusForbidden)
+        return
+    }
+
+    var result interface{}
+
+    switch action {
+    case "new", "modify":
+        var g Group
+        err = json.NewDecoder(r.Body).Decode(&g)
+
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusBadRequest)
+            return
+        }
+
+        if g.Privacy == "" {
+            g.Privacy = GroupPublic
+        }
+
+        if g.Privacy != GroupPublic && g.Privacy != GroupClosed && g.Privacy != GroupSecret {
+            http.Error(w, "Unknown privacy " + g.Privacy, http.StatusBadRequest)
+            return
+        }
+
+        if action == "new" {
+            err = createGroup(r.Context(), url, user, g)
+        } else {
+            err = modifyGroup(r.Context(), url, user, g)
+        }
+    case "get":
+        result, err = loadGroup(r.Context(), url, user)
+    case "delete":
+        err = deleteGroup(r.Context(), url, user)
+    case "join":
+        err = joinGroup(r.Context(), url, user)
+    case "leave":
+        err = removeMember(r.Context(), url, user, user)
+    case "invite":
+        err = inviteMember(r.Context(), url, user, member)
+    case "approve":
+        err = approveMember(r.Context(), url, user, member)
+    case "remove":
+        err = removeMember(r.Context(), url, user, member)
+    case "role":
+        var req struct {
+            Role string `json:"role"`
+        }
+
+        err = json.NewDecoder(r.Body).Decode(&req)
+
+        if err != nil && err != io.EOF {
+            http.Error(w, err.Error(), http.StatusBadRequest)
+            return
+        }
+
+        err = setMemberRole(r.Context(), url, user, member, req.Role)
+    case "members":
+        result, err = loadMembers(r.Context(), url, user)
+    case "feed":
+        var before time.Time
+
+        if b := r.URL.Query().Get("before"); b != "" {
+            before, err = time.Parse(time.RFC3339Nano, b)
+
+            if err != nil {
+                http.Error(w, err.Error(), http.StatusBadRequest)
+                return
+            }
+        }
+
+        result, err = getGroupPosts(r.Context(), url, user, before)
+    default:
+        http.NotFound(w, r)
+        return
+    }
+
+    if err != nil {
+        switch err {
+        case sql.ErrNoRows:
+            http.NotFound(w, r)
+        case errNotPermitted:
+            http.Error(w, err.Error(), http.StatusForbidden)
+        default:
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+            log.Println(err)
+        }
+        return
+    }
+
+    switch action {
+    case "join", "leave":
+        invalidateTimelines(r.Context(), user)
+    case "approve", "remove":
+        invalidateTimelines(r.Context(), member)
+    }
+
+    if result == nil {
+        w.WriteHeader(http.StatusOK)
+        return
+    }
+
+    err = json.NewEncoder(w).Encode(result)
+
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+    }
+}
+
+// Returns the user's role and status in a group, both empty if they have
+// no membership, along with the group's privacy. A secret group the user is
+// not a member of is reported as sql.ErrNoRows, as if it did not exist.
+func membership(ctx context.Context, group string, user string) (string, string, string, error) {
+    query := `SELECT g.privacy, COALESCE(m.role, ''), COALESCE(m.status, '')
+            FROM groups g
+            LEFT JOIN membership m ON m.groupurl = g.url AND m.profileurl = $2
+            WHERE g.url = $1;`
+
+    var privacy, role, status string
+    err := db.QueryRowContext(ctx, query, group, user).Scan(&privacy, &role, &status)
+
+    if err == nil && privacy == GroupSecret && status == "" {
+        err = sql.ErrNoRows
+    }
+
+    return privacy, role, status, err
+}
+
+// Checks the user is a full member of the group with at least the given role.
+func requireRole(ctx context.Context, group string, user string, role string) error {
+    _, r, status, err := membership(ctx, group, user)
+
+    if err != nil {
+        return err
+    }
+
+    if status != StatusMember || roleRank[r] < roleRank[role] {
+        return errNotPermitted
+    }
+
+    return nil
+}
+
+func createGroup(ctx context.Context, url string, creator string, g Group) error {
+    ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+    defer cancel()
+
+    tx, err := db.BeginTx(ctx, nil)
+
+    if err != nil {
+        return err
+    }
+
+    query := `INSERT INTO groups (url, name, description, privacy)
+            VALUES ($1, $2, $3, $4);`
+
+    _, err = tx.ExecContext(ctx, query, url, g.Name, g.Description, g.Privacy)
+
+    if err == nil {
+        query = `INSERT INTO membership (groupurl, profileurl, role, status)
+                VALUES ($1, $2, $3, $4);`
+
+        _, err = tx.ExecContext(ctx, query, url, creator, RoleAdmin, StatusMember)
+    }
+
+    if err != nil {
+        tx.Rollback()
+        return err
+    }
+
+    return tx.Commit()
+}
+
+func loadGroup(ctx context.Context, url string, user string) (*Group, error) {
+    ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+    defer cancel()
+
+    _, role, status, err := membership(ctx, url, user)
+
+    if err != nil {
+        return nil, err
+    }
+
+    query := `SELECT url, name, description, privacy, created,
+                (SELECT COUNT(*)
+                FROM membership m
+                WHERE m.groupurl = groups.url
+                AND m.status = 'member')
+            FROM groups
+            WHERE url = $1;`
+
+    g := Group{Role: role, Status: status}
+    err = db.QueryRowContext(ctx, query, url).Scan(&g.URL, &g.Name, &g.Description,
+            &g.Privacy, &g.Created, &g.Members)
+
+    if err != nil {
+        return nil, err
+    }
+
+    return &g, nil
+}
+
+func modifyGroup(ctx context.Context, url string, user string, g Group) error {
+    ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+    defer cancel()
+
+    err := requireRole(ctx, url, user, RoleAdmin)
+
+    if err != nil {
+        return err
+    }
+
+    query := `UPDATE groups
+            SET name = $1, description = $2, privacy = $3
+            WHERE url = $4;`
+
+    _, err = db.ExecContext(ctx, query, g.Name, g.Description, g.Privacy, url)
+
+    return err
+}
+
+// Removes a group along with its memberships, its events and everything
+// posted in it.
+func deleteGroup(ctx context.Context, url string, user string) error {
+    ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+    defer cancel()
+
+    err := requireRole(ctx, url, user, RoleAdmin)
+
+    if err != nil {
+        return err
+    }
+
+    tx, err := db.BeginTx(ctx, nil)
+
+    if err != nil {
+        return err
+    }
+
+    err = purgeGroup(ctx, tx, url)
+
+    if err != nil {
+        tx.Rollback()
+        return err
+    }
+
+    return tx.Commit()
+}
+
+// Removes a group with its events, posts and memberships.
+func purgeGroup(ctx context.Context, tx *sql.Tx, url string) error {
+    err := purgeEvents(ctx, tx, "groupurl = $1", url)
+
+    if err != nil {
+        return err
+    }
+
+    queries := []string{
+        `DELETE FROM reaction
+            WHERE (post = true
+                AND postid IN (SELECT id FROM post WHERE groupurl = $1))
+            OR (post = false
+                AND commentid IN (SELECT c.id
+                                FROM comment c, post p
+                                WHERE c.postid = p.id
+                                AND p.groupurl = $1));`,
+        `DELETE FROM comment
+            WHERE postid IN (SELECT id FROM post WHERE groupurl = $1);`,
+        `DELETE FROM post
+            WHERE groupurl = $1;`,
+        `DELETE FROM membership
+            WHERE groupurl = $1;`,
+        `DELETE FROM groups
+            WHERE url = $1;`,
+    }
+
+    for _, query := range queries {
+        _, err = tx.ExecContext(ctx, query, url)
+
+        if err != nil {
+            return err
+        }
+    }
+
+    return nil
+}
+
+// Keeps groups run when their only admin's profile is removed: the
+// longest-standing moderator, or failing that member, takes over. Groups
+// with nobody left to take over are removed.
+func handOverGroups(ctx context.Context, tx *sql.Tx, url string) error {
+    query := `UPDATE membership m
+            SET role = $2
+            FROM (SELECT DISTINCT ON (o.groupurl) o.groupurl, o.profileurl
+                FROM membership a, membership o
+                WHERE a.profileurl = $1
+                AND a.role = $2
+                AND o.groupurl = a.groupurl
+                AND o.profileurl <> $1
+                AND o.status = $3
+                AND NOT EXISTS (SELECT *
+                                FROM membership x
+                                WHERE x.groupurl = a.groupurl
+                                AND x.profileurl <> $1
+                                AND x.role = $2
+                                AND x.status = $3)
+                ORDER BY o.groupurl, o.role = $4 DESC, o.timestamp) s
+            WHERE m.groupurl = s.groupurl
+            AND m.profileurl = s.profileurl;`
+
+    _, err := tx.ExecContext(ctx, query, url, RoleAdmin, StatusMember, RoleModerator)
+
+    if err != nil {
+        return err
+    }
+
+    query = `SELECT a.groupurl
+            FROM membership a
+            WHERE a.profileurl = $1
+            AND a.role = $2
+            AND NOT EXISTS (SELECT *
+                            FROM membership x
+                            WHERE x.groupurl = a.groupurl
+                            AND x.profileurl <> $1
+                            AND x.role = $2
+                            AND x.status = $3);`
+
+    rows, err := tx.QueryContext(ctx, query, url, RoleAdmin, StatusMember)
+
+    if err != nil {
+        return err
+    }
+
+    var orphaned []string
+
+    for rows.Next() {
+        var group string
+        err = rows.Scan(&group)
+
+        if err != nil {
+            rows.Close()
+            return err
+        }
+
+        orphaned = append(orphaned, group)
+    }
+
+    rows.Close()
+
+    if err = rows.Err(); err != nil {
+        return err
+    }
+
+    for _, group := range orphaned {
+        err = purgeGroup(ctx, tx, group)
+
+        if err != nil {
+            return err
+        }
+    }
+
+    return nil
+}
+
+// Joining a public group, or any group the user has been invited to, makes
+// them a member. Joining a closed group records a request for a moderator
+// to approve. Secret groups cannot be joined uninvited.
+func joinGroup(ctx context.Context, url string, user string) error {
+    ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+    defer cancel()
+
+    privacy, _, status, err := membership(ctx, url, user)
+
+    if err != nil {
+        return err
+    }
+
+    if status == StatusMember || status == StatusRequested {
+        return nil
+    }
+
+    next := StatusMember
+
+    if status != StatusInvited && privacy == GroupClosed {
+        next = StatusRequested
+    }
+
+    query := `INSERT INTO membership (groupurl, profileurl, role, status)
+            VALUES ($1, $2, $3, $4)
+            ON CONFLICT (groupurl, profileurl) DO UPDATE
+            SET status = $4, timestamp = now();`
+
+    _, err = db.ExecContext(ctx, query, url, user, RoleMember, next)
+
+    return err
+}
+
+// Any member can invite others to public and closed groups; inviting to a
+// secret group needs a moderator.
+func inviteMember(ctx context.Context, url string, user string, invitee string) error {
+    ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+    defer cancel()
+
+    privacy, _, _, err := membership(ctx, url, user)
+
+    if err != nil {
+        return err
+    }
+
+    required := RoleMember
+
+    if privacy == GroupSecret {
+        required = RoleModerator
+    }
+
+    err = requireRole(ctx, url, user, required)
+
+    if err != nil {
+        return err
+    }
+
+    query := `INSERT INTO membership (groupurl, profileurl, role, status, invitedby)
+            VALUES ($1, $2, $3, $4, $5)
+            ON CONFLICT DO NOTHING;`
+
+    _, err = db.ExecContext(ctx, query, url, invitee, RoleMember, StatusInvited, user)
+
+    return err
+}
+
+func approveMember(ctx context.Context, url string, user string, member string) error {
+    ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+    defer cancel()
+
+    err := requireRole(ctx, url, user, RoleModerator)
+
+    if err != nil {
+        return err
+    }
+
+    query := `UPDATE membership
+            SET status = $3, timestamp = now()
+            WHERE groupurl = $1
+            AND profileurl = $2
+            AND status = $4;`
+
+    _, err = db.ExecContext(ctx, query, url, member, StatusMember, StatusRequested)
+
+    return err
+}
+
+// Members can always remove themselves. Removing someone else needs a role
+// above theirs.
+func removeMember(ctx context.Context, url string, user string, member string) error {
+    ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+    defer cancel()
+
+    if member != user {
+        _, role, status, err := membership(ctx, url, user)
+
+        if err != nil {
+            return err
+        }
+
+        _, theirRole, _, err := membership(ctx, url, member)
+
+        if err != nil {
+            return err
+        }
+
+        if status != StatusMember || role == RoleMember || roleRank[role] <= roleRank[theirRole] {
+            return errNotPermitted
+        }
+    }
+
+    query := `DELETE FROM membership
+            WHERE groupurl = $1
+            AND profileurl = $2;`
+
+    _, err := db.ExecContext(ctx, query, url, member)
+
+    return err
+}
+
+func setMemberRole(ctx context.Context, url string, user string, member string, role string) error {
+    ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+    defer cancel()
+
+    if _, ok := roleRank[role]; !ok {
+        return errors.New("Unknown role " + role)
+    }
+
+    err := requireRole(ctx, url, user, RoleAdmin)
+
+    if err != nil {
+        return err
+    }
+
+    query := `UPDATE membership
+            SET role = $3
+            WHERE groupurl = $1
+            AND profileurl = $2
+            AND status = $4;`
+
+    _, err = db.ExecContext(ctx, query, url, member, role, StatusMember)
+
+    return err
+}
+
+// Members of closed and secret groups are only listed to members. Pending
+// requests and invitations are only listed to moderators.
+func loadMembers(ctx context.Context, url string, user string) ([]Member, error) {
+    ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+    defer cancel()
+
+    privacy, role, status, err := membership(ctx, url, user)
+
+    if err != nil {
+        return nil, err
+    }
+
+    if privacy != GroupPublic && status != StatusMember {
+        return nil, errNotPermitted
+    }
+
+    moderator := status == StatusMember && roleRank[role] >= roleRank[RoleModerator]
+
+    query := `SELECT p.url, p.firstname, p.lastname, m.role, m.status
+            FROM membership m, profile p
+            WHERE m.groupurl = $1
+            AND p.url = m.profileurl
+            AND ($2 OR m.status = 'member')
+            ORDER BY m.status, m.role, p.lastname, p.firstname;`
+
+    rows, err := db.QueryContext(ctx, query, url, moderator)
+
+    if err != nil {
+        return nil, err
+    }
+
+    defer rows.Close()
+
+    members := []Member{}
+
+    for rows.Next() {
+        var m Member
+        err = rows.Scan(&m.URL, &m.FirstName, &m.LastName, &m.Role, &m.Status)
+
+        if err != nil {
+            return nil, err
+        }
+
+        members = append(members, m)
+    }
+
+    return members, rows.Err()
+}
+
+func getGroupPosts(ctx context.Context, url string, user string, before time.Time) ([]Post, error) {
+    ctx, cancel := context.WithTimeout(ctx, feedTimeout)
+    defer cancel()
+
+    privacy, _, status, err := membership(ctx, url, user)
+
+    if err != nil {
+        return nil, err
+    }
+
+    if privacy != GroupPublic && status != StatusMember {
+        return nil, errNotPermitted
+    }
+
+    if before.IsZero() {
+        before = time.Now()
+    }
+
+    query := `SELECT id, profileurl, authorurl, groupurl, timestamp, content
+            FROM post
+            WHERE groupurl = $1
+            AND deleted IS NULL
+            AND timestamp < $2
+            ORDER BY timestamp DESC
+            LIMIT $3;`
+
+    rows, err := db.QueryContext(ctx, query, url, before, PostsPerRequest)
+
+    if err != nil {
+        return nil, err
+    }
+
+    defer rows.Close()
+
+    results := []Post{}
+
+    for rows.Next() {
+        var post Post
+        err = rows.Scan(&post.ID, &post.ProfileUrl, &post.AuthorUrl, &post.GroupUrl,
+                &post.Timestamp, &post.Content)
+
+        if err != nil {
+            return nil, err
+        }
+
+        results = append(results, post)
+    }
+
+    if err = rows.Err(); err != nil {
+        return nil, err
+    }
+
+    return results, decoratePosts(ctx, results, user)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+    "context"
+    "net/http"
+    "encoding/json"
+    "log"
+    "os"
+    "sync/atomic"
+    "time"
+)
+
+// Set once shutdown begins so the load balancer stops routing new
+// requests here while in-flight ones drain.
+var draining int32
+
+const defaultDrainPeriod = 15 * time.Second
+
+// How long /readyz reports draining before the listener closes, taken from
+// NETWRK_DRAIN_PERIOD when set. It must be longer than the load balancer's
+// probe interval, or the balancer never sees the server go unready.
+func drainPeriod() time.Duration {
+    period := defaultDrainPeriod
+
+    if env := os.Getenv("NETWRK_DRAIN_PERIOD"); env != "" {
+        d, err := time.ParseDuration(env)
+
+        if err != nil {
+            log.Println("Invalid NETWRK_DRAIN_PERIOD: " + err.Error())
+        } else {
+            period = d
+        }
+    }
+
+    return period
+}
+
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+    w.WriteHeader(http.StatusOK)
+    w.Write([]byte("ok"))
+}
+
+func readyHandler(w http.ResponseWriter, r *http.Request) {
+    var status struct {
+        Database    string  `json:"database"`
+        Schema      int     `json:"schema"`
+        Expected    int     `json:"expected"`
+        Draining    bool    `json:"draining"`
+    }
+
+    ready := true
+    status.Expected = len(migrations)
+    status.Draining = atomic.LoadInt32(&draining) == 1
+
+    if status.Draining {
+        ready = false
+    }
+
+    ctx, cancel := context.WithTimeout(r.Context(), queryTimeout)
+    defer cancel()
+
+    err := db.PingContext(ctx)
+
+    if err != nil {
+        log.Println("Readiness check: " + err.Error())
+        status.Database = "unavailable"
+        ready = false
+    } else {
+        status.Database = "ok"
+        status.Schema, err = schemaVersion(ctx)
+
+        if err != nil {
+            log.Println(err)
+            ready = false
+        } else if status.Schema != status.Expected {
+            ready = false
+        }
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+
+    if ready {
+        w.WriteHeader(http.StatusOK)
+    } else {
+        w.WriteHeader(http.StatusServiceUnavailable)
+    }
+
+    err = json.NewEncoder(w).Encode(status)
+
+    if err != nil {
+        log.Println(err)
+    }
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+    "context"
+    "log"
+    "time"
+)
+
+// Runs job immediately and then every interval until ctx is cancelled.
+// Errors are logged and the job retried on the next tick.
+func runPeriodically(ctx context.Context, name string, interval time.Duration,
+        job func(context.Context) error) {
+
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+
+    for {
+        err := job(ctx)
+
+        if err != nil {
+            log.Println(name + ": " + err.Error())
+        }
+
+        select {
+        case <-ctx.Done():
+            return
+        case <-ticker.C:
+        }
+    }
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+    "net/http"
+    "github.com/gorilla/mux"
+    "github.com/prometheus/client_golang/prometheus"
+    "github.com/prometheus/client_golang/prometheus/collectors"
+    "github.com/prometheus/client_golang/prometheus/promhttp"
+    "os"
+    "strconv"
+    "time"
+)
+
+var (
+    requestCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+        Name: "netwrk_http_requests_total",
+        Help: "HTTP requests handled, by route template, method and status code.",
+    }, []string{"route", "method", "code"})
+
+    requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+        Name: "netwrk_http_request_duration_seconds",
+        Help: "HTTP request latency, by route template and method.",
+        Buckets: prometheus.DefBuckets,
+    }, []string{"route", "method"})
+
+    authDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+        Name: "netwrk_auth_bcrypt_duration_seconds",
+        Help: "Time spent comparing bcrypt password hashes during authentication.",
+        Buckets: []float64{.01, .025, .05, .1, .25, .5, 1, 2.5},
+    }, []string{"result"})
+
+    postsCreated = prometheus.NewCounter(prometheus.CounterOpts{
+        Name: "netwrk_posts_created_total",
+        Help: "Posts created.",
+    })
+
+    commentsCreated = prometheus.NewCounter(prometheus.CounterOpts{
+        Name: "netwrk_comments_created_total",
+        Help: "Comments created.",
+    })
+
+    registrations = prometheus.NewCounter(prometheus.CounterOpts{
+        Name: "netwrk_registrations_total",
+        Help: "Accounts registered.",
+    })
+
+    connectionRequests = prometheus.NewCounter(prometheus.CounterOpts{
+        Name: "netwrk_connection_requests_total",
+        Help: "Connection requests created.",
+    })
+)
+
+type statusRecorder struct {
+    http.ResponseWriter
+    code int
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+    s.code = code
+    s.ResponseWriter.WriteHeader(code)
+}
+
+// Streaming handlers still need to flush through the recorder.
+func (s *statusRecorder) Flush() {
+    if f, ok := s.ResponseWriter.(http.Flusher); ok {
+        f.Flush()
+    }
+}
+
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+    return s.ResponseWriter
+}
+
+func registerMetrics(r *mux.Router) {
+    prometheus.MustRegister(requestCount, requestDuration, authDuration,
+            postsCreated, commentsCreated, registrations, connectionRequests)
+    prometheus.MustRegister(collectors.NewDBStatsCollector(db, "netwrk"))
+
+    r.Use(metricsMiddleware)
+}
+
+const defaultMetricsAddr = "127.0.0.1:9100"
+
+// Metrics are served on their own listener, kept off the public one,
+// at NETWRK_METRICS_ADDR when set.
+func metricsServer() *http.Server {
+    addr := defaultMetricsAddr
+
+    if env := os.Getenv("NETWRK_METRICS_ADDR"); env != "" {
+        addr = env
+    }
+
+    handler := http.NewServeMux()
+    handler.Handle("/metrics", promhttp.Handler())
+
+    return &http.Server{
+        Addr: addr,
+        Handler: handler,
+        ReadHeaderTimeout: 5 * time.Second,
+    }
+}
+
+func metricsMiddleware(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        route := "unknown"
+
+        if current := mux.CurrentRoute(r); current != nil {
+            if tmpl, err := current.GetPathTemplate(); err == nil {
+                route = tmpl
+            }
+        }
+
+        rec := &statusRecorder{w, http.StatusOK}
+        start := time.Now()
+
+        next.ServeHTTP(rec, r)
+
+        requestDuration.WithLabelValues(route, r.Method).Observe(time.Since(start).Seconds())
+        requestCount.WithLabelValues(route, r.Method, strconv.Itoa(rec.code)).Inc()
+    })
+}
+
+func observeAuth(start time.Time, err error) {
+    result := "success"
+
+    if err != nil {
+        result = "failure"
+    }
+
+    authDuration.WithLabelValues(result).Observe(time.Since(start).Seconds())
+}
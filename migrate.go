@@ -0,0 +1,301 @@
+package main
+
+import (
+    "context"
+    _ "github.com/lib/pq"
+    "log"
+    "strconv"
+)
+
+// Schema changes, applied in order. The schema version is the number of
+// entries applied, so new migrations are only ever appended.
+var migrations = []string{
+    // 1: deactivated accounts awaiting deletion
+    `ALTER TABLE account ADD COLUMN deactivated timestamp;`,
+    // 2: personal data exports
+    `CREATE TABLE export (
+        token text PRIMARY KEY,
+        acctEmail text NOT NULL,
+        requested timestamp NOT NULL DEFAULT now(),
+        completed timestamp,
+        expires timestamp,
+        failed boolean NOT NULL DEFAULT false,
+        path text);`,
+    // 3: blocked profiles
+    `CREATE TABLE block (
+        blocker text NOT NULL,
+        blocked text NOT NULL,
+        timestamp timestamp NOT NULL DEFAULT now(),
+        PRIMARY KEY (blocker, blocked));`,
+    // 4: full-text search over post and comment content
+    `ALTER TABLE post ADD COLUMN tsv tsvector
+        GENERATED ALWAYS AS (to_tsvector('english', coalesce(content, ''))) STORED;
+    CREATE INDEX post_tsv_idx ON post USING gin(tsv);
+    ALTER TABLE comment ADD COLUMN tsv tsvector
+        GENERATED ALWAYS AS (to_tsvector('english', coalesce(content, ''))) STORED;
+    CREATE INDEX comment_tsv_idx ON comment USING gin(tsv);`,
+    // 5: trigram people search
+    `CREATE EXTENSION IF NOT EXISTS pg_trgm;
+    CREATE INDEX profile_name_trgm_idx ON profile
+        USING gin ((lower(firstname || ' ' || lastname)) gin_trgm_ops);`,
+    // 6: dismissed connection suggestions
+    `CREATE TABLE dismissal (
+        url text NOT NULL,
+        dismissed text NOT NULL,
+        timestamp timestamp NOT NULL DEFAULT now(),
+        PRIMARY KEY (url, dismissed));`,
+    // 7: relationship types and proposed changes to them
+    `ALTER TABLE connection
+        ADD COLUMN type text NOT NULL DEFAULT 'friend',
+        ADD COLUMN proposedtype text,
+        ADD COLUMN proposedfromdesc text,
+        ADD COLUMN proposedtodesc text,
+        ADD COLUMN proposedby text;`,
+    // 8: pending request inbox and outbox
+    `ALTER TABLE connection
+        ADD COLUMN requested timestamp NOT NULL DEFAULT now(),
+        ADD COLUMN declined timestamp;
+    CREATE INDEX connection_pending_to_idx ON connection (tourl, requested) WHERE NOT accepted;
+    CREATE INDEX connection_pending_from_idx ON connection (fromurl, requested) WHERE NOT accepted;`,
+    // 9: follows and private profiles
+    `ALTER TABLE profile ADD COLUMN private boolean NOT NULL DEFAULT false;
+    CREATE TABLE follow (
+        follower text NOT NULL,
+        followed text NOT NULL,
+        approved boolean NOT NULL DEFAULT false,
+        timestamp timestamp NOT NULL DEFAULT now(),
+        PRIMARY KEY (follower, followed));
+    CREATE INDEX follow_followed_idx ON follow (followed);`,
+    // 10: groups, memberships and group posts
+    `CREATE TABLE groups (
+        url text PRIMARY KEY,
+        name text NOT NULL,
+        description text NOT NULL DEFAULT '',
+        privacy text NOT NULL DEFAULT 'public',
+        created timestamp NOT NULL DEFAULT now());
+    CREATE TABLE membership (
+        groupurl text NOT NULL REFERENCES groups (url),
+        profileurl text NOT NULL,
+        role text NOT NULL DEFAULT 'member',
+        status text NOT NULL,
+        invitedby text,
+        timestamp timestamp NOT NULL DEFAULT now(),
+        PRIMARY KEY (groupurl, profileurl));
+    CREATE INDEX membership_profile_idx ON membership (profileurl);
+    ALTER TABLE post ADD COLUMN groupurl text;
+    CREATE INDEX post_group_idx ON post (groupurl, timestamp) WHERE groupurl IS NOT NULL;`,
+    // 11: events, invitations and RSVPs, and event wall posts
+    `CREATE TABLE event (
+        id serial PRIMARY KEY,
+        ownerurl text NOT NULL,
+        groupurl text REFERENCES groups (url),
+        title text NOT NULL,
+        description text NOT NULL DEFAULT '',
+        starts timestamp NOT NULL,
+        ends timestamp,
+        location text NOT NULL DEFAULT '',
+        created timestamp NOT NULL DEFAULT now());
+    CREATE TABLE attendee (
+        eventid integer NOT NULL REFERENCES event (id),
+        profileurl text NOT NULL,
+        status text NOT NULL,
+        invitedby text,
+        timestamp timestamp NOT NULL DEFAULT now(),
+        PRIMARY KEY (eventid, profileurl));
+    CREATE INDEX attendee_profile_idx ON attendee (profileurl);
+    ALTER TABLE post ADD COLUMN eventid integer REFERENCES event (id);
+    CREATE INDEX post_event_idx ON post (eventid, timestamp) WHERE eventid IS NOT NULL;`,
+
+    // 12: shares, which keep their id after the original is deleted
+    `ALTER TABLE post ADD COLUMN sharedid integer;
+    CREATE INDEX post_shared_idx ON post (sharedid) WHERE sharedid IS NOT NULL;`,
+
+    // 13: mentions and hashtags, and notifications
+    `CREATE TABLE entity (
+        kind text NOT NULL,
+        postid integer REFERENCES post (id) ON DELETE CASCADE,
+        commentid integer REFERENCES comment (id) ON DELETE CASCADE,
+        value text NOT NULL,
+        start integer NOT NULL,
+        length integer NOT NULL,
+        created timestamp NOT NULL DEFAULT now());
+    CREATE INDEX entity_post_idx ON entity (postid) WHERE postid IS NOT NULL;
+    CREATE INDEX entity_comment_idx ON entity (commentid) WHERE commentid IS NOT NULL;
+    CREATE INDEX entity_value_idx ON entity (kind, value, created);
+    CREATE TABLE notification (
+        id serial PRIMARY KEY,
+        profileurl text NOT NULL,
+        kind text NOT NULL,
+        actorurl text,
+        postid integer,
+        commentid integer,
+        created timestamp NOT NULL DEFAULT now(),
+        read timestamp);
+    CREATE INDEX notification_profile_idx ON notification (profileurl, created);`,
+
+    // 14: cached link previews
+    `CREATE TABLE preview (
+        url text PRIMARY KEY,
+        title text NOT NULL DEFAULT '',
+        description text NOT NULL DEFAULT '',
+        image text NOT NULL DEFAULT '',
+        site text NOT NULL DEFAULT '',
+        failed boolean NOT NULL DEFAULT false,
+        fetched timestamp NOT NULL DEFAULT now());`,
+
+    // 15: edit history for posts and comments
+    `CREATE TABLE revision (
+        postid integer REFERENCES post (id) ON DELETE CASCADE,
+        commentid integer REFERENCES comment (id) ON DELETE CASCADE,
+        content text NOT NULL,
+        timestamp timestamp NOT NULL);
+    CREATE INDEX revision_post_idx ON revision (postid, timestamp) WHERE postid IS NOT NULL;
+    CREATE INDEX revision_comment_idx ON revision (commentid, timestamp) WHERE commentid IS NOT NULL;
+    ALTER TABLE post ADD COLUMN edited timestamp;
+    ALTER TABLE comment ADD COLUMN edited timestamp;`,
+
+    // 16: soft deletion of posts and comments
+    `ALTER TABLE post ADD COLUMN deleted timestamp;
+    ALTER TABLE comment ADD COLUMN deleted timestamp;
+    CREATE INDEX post_deleted_idx ON post (deleted) WHERE deleted IS NOT NULL;
+    CREATE INDEX comment_deleted_idx ON comment (deleted) WHERE deleted IS NOT NULL;`,
+
+    // 17: drafts and scheduled posts
+    `CREATE TABLE draft (
+        id serial PRIMARY KEY,
+        authorurl text NOT NULL,
+        profileurl text NOT NULL,
+        content text NOT NULL,
+        groupurl text,
+        eventid integer,
+        publishat timestamp,
+        updated timestamp NOT NULL DEFAULT now());
+    CREATE INDEX draft_author_idx ON draft (authorurl);
+    CREATE INDEX draft_publish_idx ON draft (publishat) WHERE publishat IS NOT NULL;`,
+
+    // 18: stories and who has viewed them
+    `CREATE TABLE story (
+        id serial PRIMARY KEY,
+        profileurl text NOT NULL,
+        content text NOT NULL DEFAULT '',
+        image text NOT NULL DEFAULT '',
+        created timestamp NOT NULL DEFAULT now(),
+        expires timestamp NOT NULL);
+    CREATE INDEX story_profile_idx ON story (profileurl, expires);
+    CREATE TABLE storyview (
+        storyid integer NOT NULL REFERENCES story (id) ON DELETE CASCADE,
+        viewerurl text NOT NULL,
+        timestamp timestamp NOT NULL DEFAULT now(),
+        PRIMARY KEY (storyid, viewerurl));`,
+
+    // 19: polls in posts
+    `CREATE TABLE poll (
+        postid integer PRIMARY KEY REFERENCES post (id) ON DELETE CASCADE,
+        question text NOT NULL,
+        multiple boolean NOT NULL DEFAULT false,
+        closes timestamp,
+        hideresults boolean NOT NULL DEFAULT false,
+        closed timestamp);
+    CREATE INDEX poll_closes_idx ON poll (closes) WHERE closed IS NULL;
+    CREATE TABLE polloption (
+        id serial PRIMARY KEY,
+        postid integer NOT NULL REFERENCES poll (postid) ON DELETE CASCADE,
+        position integer NOT NULL,
+        text text NOT NULL);
+    CREATE INDEX polloption_post_idx ON polloption (postid);
+    CREATE TABLE vote (
+        postid integer NOT NULL REFERENCES poll (postid) ON DELETE CASCADE,
+        optionid integer NOT NULL REFERENCES polloption (id) ON DELETE CASCADE,
+        voterurl text NOT NULL,
+        timestamp timestamp NOT NULL DEFAULT now(),
+        PRIMARY KEY (optionid, voterurl));
+    CREATE INDEX vote_voter_idx ON vote (postid, voterurl);`,
+
+    // 20: materialised feed timelines and indexes for the feed query. Posts
+    // from before timelines existed count as fanned out, since timelines
+    // are backfilled when built.
+    `ALTER TABLE post ADD COLUMN fannedout boolean NOT NULL DEFAULT true;
+    ALTER TABLE post ALTER COLUMN fannedout SET DEFAULT false;
+    CREATE INDEX post_timestamp_idx ON post (timestamp) WHERE deleted IS NULL;
+    CREATE INDEX post_profile_idx ON post (profileurl, timestamp);
+    CREATE INDEX post_author_idx ON post (authorurl, timestamp);
+    CREATE INDEX post_unfanned_idx ON post (timestamp) WHERE NOT fannedout;
+    CREATE INDEX connection_from_idx ON connection (fromurl) WHERE accepted;
+    CREATE INDEX connection_to_idx ON connection (tourl) WHERE accepted;
+    CREATE TABLE timelinestate (
+        owner text PRIMARY KEY,
+        built timestamp NOT NULL DEFAULT now(),
+        ready boolean NOT NULL DEFAULT false,
+        since timestamp);
+    CREATE TABLE timeline (
+        owner text NOT NULL,
+        postid integer NOT NULL REFERENCES post (id) ON DELETE CASCADE,
+        timestamp timestamp NOT NULL,
+        PRIMARY KEY (owner, postid));
+    CREATE INDEX timeline_owner_idx ON timeline (owner, timestamp);`,
+
+    // 21: exports are built by a job that claims them; one pending per
+    // account. Exports left pending by earlier builds are given up on.
+    `ALTER TABLE export ADD COLUMN started timestamp;
+    UPDATE export
+        SET completed = now(), expires = now(), failed = true
+        WHERE completed IS NULL;
+    CREATE UNIQUE INDEX export_pending_idx ON export (acctEmail) WHERE completed IS NULL;`,
+}
+
+func migrate(ctx context.Context) error {
+    query := `CREATE TABLE IF NOT EXISTS schema_migrations (
+                version integer PRIMARY KEY,
+                applied timestamp NOT NULL DEFAULT now());`
+
+    _, err := db.ExecContext(ctx, query)
+
+    if err != nil {
+        return err
+    }
+
+    version, err := schemaVersion(ctx)
+
+    if err != nil {
+        return err
+    }
+
+    for i := version; i < len(migrations); i++ {
+        tx, err := db.BeginTx(ctx, nil)
+
+        if err != nil {
+            return err
+        }
+
+        _, err = tx.ExecContext(ctx, migrations[i])
+
+        if err == nil {
+            _, err = tx.ExecContext(ctx, `INSERT INTO schema_migrations (version) VALUES ($1);`, i + 1)
+        }
+
+        if err != nil {
+            tx.Rollback()
+            return err
+        }
+
+        err = tx.Commit()
+
+        if err != nil {
+            return err
+        }
+
+        log.Println("Applied migration " + strconv.Itoa(i + 1))
+    }
+
+    return nil
+}
+
+func schemaVersion(ctx context.Context) (int, error) {
+    query := `SELECT COALESCE(MAX(version), 0)
+            FROM schema_migrations;`
+
+    var version int
+    err := db.QueryRowContext(ctx, query).Scan(&version)
+
+    return version, err
+}
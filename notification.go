@@ -0,0 +1,164 @@
+package main
+
+import (
+    "context"
+    "net/http"
+    "github.com/gorilla/mux"
+    _ "github.com/lib/pq"
+    "encoding/json"
+    "log"
+    "time"
+)
+
+const NotificationsPerPage int = 50
+
+const (
+    NotifyMention = "mention"
+    NotifyPublished = "published"
+    NotifyPublishFailed = "publish_failed"
+    NotifyPollClosed = "poll_closed"
+)
+
+// Something that happened involving a profile. ActorUrl is the profile
+// that caused it, and PostId and CommentId what it concerns, where those
+// apply.
+type Notification struct {
+    ID          int         `json:"id"`
+    Type        string      `json:"type"`
+    ActorUrl    string      `json:"actorUrl,omitempty"`
+    PostId      int         `json:"postId,omitempty"`
+    CommentId   int         `json:"commentId,omitempty"`
+    Created     time.Time   `json:"created"`
+    Read        bool        `json:"read"`
+}
+
+// get lists the user's notifications newest first, paged with ?before;
+// read marks them all as read.
+func notificationHandler(w http.ResponseWriter, r *http.Request) {
+    vars := mux.Vars(r)
+    action := vars["action"]
+
+    email, ok := checkAuthorisation(w, r)
+
+    if !ok {
+        return
+    }
+
+    user, err := profileUrlForEmail(r.Context(), email)
+
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusForbidden)
+        return
+    }
+
+    switch action {
+    case "get":
+        var before time.Time
+
+        if b := r.URL.Query().Get("before"); b != "" {
+            before, err = time.Parse(time.RFC3339Nano, b)
+
+            if err != nil {
+                http.Error(w, err.Error(), http.StatusBadRequest)
+                return
+            }
+        }
+
+        notifications, err := loadNotifications(r.Context(), user, before)
+
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+            return
+        }
+
+        err = json.NewEncoder(w).Encode(notifications)
+
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+            log.Println(err)
+        }
+    case "read":
+        err = markNotificationsRead(r.Context(), user)
+
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+            return
+        }
+
+        w.WriteHeader(http.StatusOK)
+    default:
+        http.NotFound(w, r)
+    }
+}
+
+// Zero postId and commentId are stored as NULL. Nothing is sent between
+// profiles where either has blocked the other.
+func notify(ctx context.Context, url string, kind string, actor string, postId int, commentId int) error {
+    ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+    defer cancel()
+
+    query := `INSERT INTO notification (profileurl, kind, actorurl, postid, commentid)
+            SELECT $1, $2, NULLIF($3, ''), NULLIF($4, 0), NULLIF($5, 0)
+            WHERE NOT EXISTS (SELECT *
+                            FROM block b
+                            WHERE (b.blocker = $1 AND b.blocked = $3)
+                            OR (b.blocker = $3 AND b.blocked = $1));`
+
+    _, err := db.ExecContext(ctx, query, url, kind, actor, postId, commentId)
+
+    return err
+}
+
+func loadNotifications(ctx context.Context, url string, before time.Time) ([]Notification, error) {
+    ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+    defer cancel()
+
+    if before.IsZero() {
+        before = time.Now()
+    }
+
+    query := `SELECT id, kind, COALESCE(actorurl, ''), COALESCE(postid, 0),
+                COALESCE(commentid, 0), created, read IS NOT NULL
+            FROM notification
+            WHERE profileurl = $1
+            AND created < $2
+            ORDER BY created DESC
+            LIMIT $3;`
+
+    rows, err := db.QueryContext(ctx, query, url, before, NotificationsPerPage)
+
+    if err != nil {
+        return nil, err
+    }
+
+    defer rows.Close()
+
+    notifications := []Notification{}
+
+    for rows.Next() {
+        var n Notification
+        err = rows.Scan(&n.ID, &n.Type, &n.ActorUrl, &n.PostId, &n.CommentId, &n.Created, &n.Read)
+
+        if err != nil {
+            return nil, err
+        }
+
+        notifications = append(notifications, n)
+    }
+
+    return notifications, rows.Err()
+}
+
+func markNotificationsRead(ctx context.Context, url string) error {
+    ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+    defer cancel()
+
+    query := `UPDATE notification
+            SET read = now()
+            WHERE profileurl = $1
+            AND read IS NULL;`
+
+    _, err := db.ExecContext(ctx, query, url)
+
+    return err
+}
@@ -0,0 +1,401 @@
+package main
+
+import (
+    "context"
+    "net/http"
+    "github.com/gorilla/mux"
+    "database/sql"
+    "github.com/lib/pq"
+    "encoding/json"
+    "errors"
+    "log"
+    "strconv"
+    "strings"
+    "time"
+)
+
+const (
+    MinPollOptions = 2
+    MaxPollOptions = 10
+)
+
+var (
+    errInvalidPoll = errors.New("A poll needs a question and 2 to 10 options")
+    errPollClosed = errors.New("Poll has closed")
+    errInvalidVote = errors.New("Invalid choice of options")
+)
+
+// A poll attached to a post. When HideResults is set, vote counts are left
+// out until the viewer has voted or the poll has closed; the post's author
+// always sees them. Voted lists the options the viewer chose.
+type Poll struct {
+    Question    string          `json:"question"`
+    Options     []PollOption    `json:"options"`
+    Multiple    bool            `json:"multiple"`
+    Closes      *time.Time      `json:"closes,omitempty"`
+    HideResults bool            `json:"hideResults"`
+    Closed      bool            `json:"closed"`
+    Voters      *int            `json:"voters,omitempty"`
+    Voted       []int           `json:"voted"`
+}
+
+type PollOption struct {
+    ID          int         `json:"id"`
+    Text        string      `json:"text"`
+    Votes       *int        `json:"votes,omitempty"`
+}
+
+// Votes replace any the user cast before, so a vote can be changed until
+// the poll closes; an empty list withdraws it.
+func pollHandler(w http.ResponseWriter, r *http.Request) {
+    vars := mux.Vars(r)
+    action := vars["action"]
+    id := vars["id"]
+
+    if action != "vote" {
+        http.NotFound(w, r)
+        return
+    }
+
+    email, ok := checkAuthorisation(w, r)
+
+    if !ok {
+        return
+    }
+
+    user, err := profileUrlForEmail(r.Context(), email)
+
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusForbidden)
+        return
+    }
+
+    postId, err := strconv.Atoi(id)
+
+    if err != nil {
+        http.NotFound(w, r)
+        return
+    }
+
+    var vote struct {
+        Options []int `json:"options"`
+    }
+
+    err = json.NewDecoder(r.Body).Decode(&vote)
+
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    err = castVote(r.Context(), postId, user, vote.Options)
+
+    switch err {
+    case nil:
+        w.WriteHeader(http.StatusOK)
+    case sql.ErrNoRows:
+        http.NotFound(w, r)
+    case errPollClosed:
+        http.Error(w, err.Error(), http.StatusForbidden)
+    case errInvalidVote:
+        http.Error(w, err.Error(), http.StatusBadRequest)
+    default:
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+    }
+}
+
+func validatePoll(poll *Poll) error {
+    if strings.TrimSpace(poll.Question) == "" ||
+            len(poll.Options) < MinPollOptions || len(poll.Options) > MaxPollOptions {
+        return errInvalidPoll
+    }
+
+    for _, option := range poll.Options {
+        if strings.TrimSpace(option.Text) == "" {
+            return errInvalidPoll
+        }
+    }
+
+    if poll.Closes != nil && poll.Closes.Before(time.Now()) {
+        return errInvalidPoll
+    }
+
+    return nil
+}
+
+func savePoll(ctx context.Context, tx *sql.Tx, postId int, poll *Poll) error {
+    query := `INSERT INTO poll (postid, question, multiple, closes, hideresults)
+            VALUES ($1, $2, $3, $4, $5);`
+
+    _, err := tx.ExecContext(ctx, query, postId, poll.Question, poll.Multiple,
+            localTime(poll.Closes), poll.HideResults)
+
+    if err != nil {
+        return err
+    }
+
+    query = `INSERT INTO polloption (postid, position, text)
+            VALUES ($1, $2, $3);`
+
+    for i, option := range poll.Options {
+        _, err = tx.ExecContext(ctx, query, postId, i, option.Text)
+
+        if err != nil {
+            return err
+        }
+    }
+
+    return nil
+}
+
+func castVote(ctx context.Context, postId int, voter string, options []int) error {
+    ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+    defer cancel()
+
+    visible, err := postVisible(ctx, postId, voter)
+
+    if err != nil {
+        return err
+    }
+
+    if !visible {
+        return sql.ErrNoRows
+    }
+
+    tx, err := db.BeginTx(ctx, nil)
+
+    if err != nil {
+        return err
+    }
+
+    defer tx.Rollback()
+
+    // Locking the poll keeps a vote from slipping in as it closes.
+    query := `SELECT multiple, closed IS NOT NULL OR COALESCE(closes <= now(), false)
+            FROM poll
+            WHERE postid = $1
+            FOR UPDATE;`
+
+    var multiple, closed bool
+    err = tx.QueryRowContext(ctx, query, postId).Scan(&multiple, &closed)
+
+    if err != nil {
+        return err
+    }
+
+    if closed {
+        return errPollClosed
+    }
+
+    if !multiple && len(options) > 1 {
+        return errInvalidVote
+    }
+
+    query = `SELECT COUNT(*)
+            FROM polloption
+            WHERE postid = $1
+            AND id = ANY($2);`
+
+    var valid int
+    err = tx.QueryRowContext(ctx, query, postId, pq.Array(options)).Scan(&valid)
+
+    if err != nil {
+        return err
+    }
+
+    if valid != len(options) {
+        return errInvalidVote
+    }
+
+    query = `DELETE FROM vote
+            WHERE postid = $1
+            AND voterurl = $2;`
+
+    _, err = tx.ExecContext(ctx, query, postId, voter)
+
+    if err != nil {
+        return err
+    }
+
+    query = `INSERT INTO vote (postid, optionid, voterurl)
+            VALUES ($1, $2, $3);`
+
+    for _, option := range options {
+        _, err = tx.ExecContext(ctx, query, postId, option, voter)
+
+        if err != nil {
+            return err
+        }
+    }
+
+    return tx.Commit()
+}
+
+// Attaches polls, with results as viewer may see them, to the posts that
+// carry one.
+func addPolls(ctx context.Context, posts []*Post, viewer string) error {
+    ids := make([]int, len(posts))
+
+    for i, post := range posts {
+        ids[i] = post.ID
+    }
+
+    query := `SELECT p.postid, p.question, p.multiple, p.closes, p.hideresults,
+                p.closed IS NOT NULL OR COALESCE(p.closes <= now(), false),
+                (SELECT COUNT(DISTINCT v.voterurl) FROM vote v WHERE v.postid = p.postid)
+            FROM poll p
+            WHERE p.postid = ANY($1);`
+
+    rows, err := db.QueryContext(ctx, query, pq.Array(ids))
+
+    if err != nil {
+        return err
+    }
+
+    defer rows.Close()
+
+    polls := make(map[int]*Poll)
+    voters := make(map[int]int)
+
+    for rows.Next() {
+        var id, count int
+        poll := &Poll{Voted: []int{}}
+        err = rows.Scan(&id, &poll.Question, &poll.Multiple, &poll.Closes, &poll.HideResults,
+                &poll.Closed, &count)
+
+        if err != nil {
+            return err
+        }
+
+        polls[id] = poll
+        voters[id] = count
+    }
+
+    if err = rows.Err(); err != nil {
+        return err
+    }
+
+    if len(polls) == 0 {
+        return nil
+    }
+
+    query = `SELECT o.postid, o.id, o.text,
+                (SELECT COUNT(*) FROM vote v WHERE v.optionid = o.id),
+                EXISTS (SELECT *
+                        FROM vote v
+                        WHERE v.optionid = o.id
+                        AND v.voterurl = $2)
+            FROM polloption o
+            WHERE o.postid = ANY($1)
+            ORDER BY o.postid, o.position;`
+
+    rows, err = db.QueryContext(ctx, query, pq.Array(ids), viewer)
+
+    if err != nil {
+        return err
+    }
+
+    defer rows.Close()
+
+    for rows.Next() {
+        var id, votes int
+        var option PollOption
+        var chosen bool
+        err = rows.Scan(&id, &option.ID, &option.Text, &votes, &chosen)
+
+        if err != nil {
+            return err
+        }
+
+        option.Votes = &votes
+        polls[id].Options = append(polls[id].Options, option)
+
+        if chosen {
+            polls[id].Voted = append(polls[id].Voted, option.ID)
+        }
+    }
+
+    if err = rows.Err(); err != nil {
+        return err
+    }
+
+    for _, post := range posts {
+        poll := polls[post.ID]
+
+        if poll == nil {
+            continue
+        }
+
+        count := voters[post.ID]
+        poll.Voters = &count
+
+        if poll.HideResults && !poll.Closed && len(poll.Voted) == 0 && viewer != post.AuthorUrl {
+            poll.Voters = nil
+
+            for i := range poll.Options {
+                poll.Options[i].Votes = nil
+            }
+        }
+
+        post.Poll = poll
+    }
+
+    return nil
+}
+
+// Marks polls past their closing time as closed and tells their authors.
+// Marking and selecting happen in one statement, so each author is only
+// told once.
+func closePolls(ctx context.Context) error {
+    qctx, cancel := context.WithTimeout(ctx, queryTimeout)
+    defer cancel()
+
+    query := `UPDATE poll p
+            SET closed = now()
+            FROM post q
+            WHERE q.id = p.postid
+            AND p.closes <= now()
+            AND p.closed IS NULL
+            RETURNING p.postid, q.authorurl;`
+
+    rows, err := db.QueryContext(qctx, query)
+
+    if err != nil {
+        return err
+    }
+
+    type closed struct {
+        postId  int
+        author  string
+    }
+
+    var polls []closed
+
+    for rows.Next() {
+        var c closed
+        err = rows.Scan(&c.postId, &c.author)
+
+        if err != nil {
+            rows.Close()
+            return err
+        }
+
+        polls = append(polls, c)
+    }
+
+    rows.Close()
+
+    if err = rows.Err(); err != nil {
+        return err
+    }
+
+    for _, c := range polls {
+        err = notify(ctx, c.author, NotifyPollClosed, "", c.postId, 0)
+
+        if err != nil {
+            log.Println("Poll closed notification failed:", err)
+        }
+    }
+
+    return nil
+}
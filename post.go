@@ -1,12 +1,15 @@
 package main
 
 import (
+    "context"
     "net/http"
     "github.com/gorilla/mux"
     "database/sql"
     _ "github.com/lib/pq"
     "log"
     "encoding/json"
+    "io"
+    "strconv"
     "time"
 )
 
@@ -16,6 +19,19 @@ type Post struct {
     ID          int         `json:"id"`
     Timestamp   time.Time   `json:"timestamp"`
     Content     string      `json:"content"`
+    GroupUrl    string      `json:"groupUrl,omitempty"`
+    EventId     int         `json:"eventId,omitempty"`
+    SharedId    int         `json:"sharedId,omitempty"`
+    Shared      *Post       `json:"shared,omitempty"`
+    SharedUnavailable bool  `json:"sharedUnavailable,omitempty"`
+    Shares      int         `json:"shares"`
+    Entities    []Entity    `json:"entities,omitempty"`
+    Preview     *Preview    `json:"preview,omitempty"`
+    Edited      bool        `json:"edited"`
+    LastEdited  *time.Time  `json:"lastEdited,omitempty"`
+    Poll        *Poll       `json:"poll,omitempty"`
+    Likes       int         `json:"likes"`
+    Dislikes    int         `json:"dislikes"`
 }
 
 func postHandler(w http.ResponseWriter, r *http.Request) {
@@ -31,18 +47,23 @@ func postHandler(w http.ResponseWriter, r *http.Request) {
             return
         }
 
-        p, err := loadPost(id)
+        viewer, ok := optionalViewer(w, r)
+
+        if !ok {
+            return
+        }
+
+        p, err := loadPost(r.Context(), id, viewer)
+
+        if err == sql.ErrNoRows {
+            http.NotFound(w, r)
+            return
+        }
 
         if err != nil {
-            if err != sql.ErrNoRows {
-                http.NotFound(w, r)
-                log.Println(err)
-                return
-            } else {
-                http.Error(w, err.Error(), http.StatusInternalServerError)
-                log.Println(err)
-                return
-            }
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+            log.Println(err)
+            return
         }
 
         err = json.NewEncoder(w).Encode(p)
@@ -57,21 +78,90 @@ func postHandler(w http.ResponseWriter, r *http.Request) {
             return
         }
 
+        email, ok := checkAuthorisation(w, r)
+
+        if !ok {
+            return
+        }
+
+        author, err := profileUrlForEmail(r.Context(), email)
+
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusForbidden)
+            return
+        }
+
         var p Post
-        err := json.NewDecoder(r.Body).Decode(&p)
+        err = json.NewDecoder(r.Body).Decode(&p)
 
         if err != nil {
             http.Error(w, err.Error(), http.StatusBadRequest)
             return
         }
 
-        err = createPost(p)
+        // Posts are written as the signed-in profile, whatever the body says
+        p.AuthorUrl = author
+
+        err = createPost(r.Context(), p)
+
+        if err == errInvalidPoll {
+            http.Error(w, err.Error(), http.StatusBadRequest)
+            return
+        }
+
+        if err == errNotPermitted || err == sql.ErrNoRows {
+            http.Error(w, "Not a member of this group or event", http.StatusForbidden)
+            return
+        }
 
         if err != nil {
             http.Error(w, err.Error(), http.StatusInternalServerError)
             return
         }
 
+        postsCreated.Inc()
+
+        w.WriteHeader(http.StatusOK)
+    case "share":
+        email, ok := checkAuthorisation(w, r)
+
+        if !ok {
+            return
+        }
+
+        sharer, err := profileUrlForEmail(r.Context(), email)
+
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusForbidden)
+            return
+        }
+
+        // Commentary is optional.
+        var p Post
+
+        if r.Body != nil {
+            err = json.NewDecoder(r.Body).Decode(&p)
+
+            if err != nil && err != io.EOF {
+                http.Error(w, err.Error(), http.StatusBadRequest)
+                return
+            }
+        }
+
+        err = createShare(r.Context(), id, sharer, p.Content)
+
+        if err == sql.ErrNoRows {
+            http.NotFound(w, r)
+            return
+        }
+
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+            return
+        }
+
+        postsCreated.Inc()
+
         w.WriteHeader(http.StatusOK)
     case "delete":
         if id == "" {
@@ -79,10 +169,25 @@ func postHandler(w http.ResponseWriter, r *http.Request) {
             return
         }
 
-        //var p Post
-        //err := json.NewDecoder(r.Body).Decode(&p)
+        email, ok := checkAuthorisation(w, r)
 
-        err := deletePost(id)
+        if !ok {
+            return
+        }
+
+        user, err := profileUrlForEmail(r.Context(), email)
+
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusForbidden)
+            return
+        }
+
+        err = deletePost(r.Context(), id, user)
+
+        if err == sql.ErrNoRows {
+            http.NotFound(w, r)
+            return
+        }
 
         if err != nil {
             http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -96,15 +201,38 @@ func postHandler(w http.ResponseWriter, r *http.Request) {
             return
         }
 
-        var p Post 
-        err := json.NewDecoder(r.Body).Decode(&p)
+        email, ok := checkAuthorisation(w, r)
+
+        if !ok {
+            return
+        }
+
+        author, err := profileUrlForEmail(r.Context(), email)
+
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusForbidden)
+            return
+        }
+
+        var p Post
+        err = json.NewDecoder(r.Body).Decode(&p)
 
         if err != nil {
             http.Error(w, err.Error(), http.StatusBadRequest)
             return
         }
 
-        err = editPost(id, p.Content)
+        err = editPost(r.Context(), id, author, p.Content)
+
+        if err == errEditWindow || err == errNotPermitted {
+            http.Error(w, err.Error(), http.StatusForbidden)
+            return
+        }
+
+        if err == sql.ErrNoRows {
+            http.NotFound(w, r)
+            return
+        }
 
         if err != nil {
             http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -118,49 +246,210 @@ func postHandler(w http.ResponseWriter, r *http.Request) {
     }
 }
 
+// A post as seen by viewer, or sql.ErrNoRows if they can't see it.
+func loadPost(ctx context.Context, id string, viewer string) (*Post, error) {
+    ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+    defer cancel()
 
-func loadPost(id string) (*Post, error) {
     var post Post
 
-    query := `SELECT profileurl, authorurl, timestamp, content
+    query := `SELECT id, profileurl, authorurl, timestamp, content, COALESCE(groupurl, ''),
+                COALESCE(eventid, 0)
             FROM post
-            WHERE id = $1;`
+            WHERE id = $1
+            AND deleted IS NULL;`
+
+    err := db.QueryRowContext(ctx, query, id).Scan(&(post.ID), &(post.ProfileUrl),
+            &(post.AuthorUrl), &(post.Timestamp), &(post.Content), &(post.GroupUrl),
+            &(post.EventId))
+
+    if err != nil {
+        return nil, err
+    }
+
+    visible, err := postVisible(ctx, post.ID, viewer)
+
+    if err != nil {
+        return nil, err
+    }
+
+    if !visible {
+        return nil, sql.ErrNoRows
+    }
 
-    err := db.QueryRow(query, id).Scan(&(post.ProfileUrl),
-            &(post.AuthorUrl), &(post.Timestamp), &(post.Content))
+    posts := []Post{post}
+    err = decoratePosts(ctx, posts, viewer)
 
     if err != nil {
         return nil, err
     }
 
-    return &post, nil
+    return &posts[0], nil
 }
 
-func createPost(post Post) error {
-    query := `INSERT INTO post (profileurl, authorurl, content)
-            VALUES ($1, $2, $3);`
+func createPost(ctx context.Context, post Post) error {
+    ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+    defer cancel()
+
+    tx, err := db.BeginTx(ctx, nil)
+
+    if err != nil {
+        return err
+    }
+
+    defer tx.Rollback()
+
+    id, mentioned, err := insertPost(ctx, tx, post)
+
+    if err != nil {
+        return err
+    }
+
+    err = tx.Commit()
+
+    if err != nil {
+        return err
+    }
 
-    _, err := db.Exec(query, post.ProfileUrl, post.AuthorUrl, post.Content)
+    notifyMentions(ctx, mentioned, post.AuthorUrl, id, 0)
+    warmPreview(ctx, post.Content)
+    fanOut(ctx, id)
 
-    return err
+    return nil
 }
 
-func deletePost(id string) error {
+// Posts to a group or an event wall are kept off the author's profile. They
+// need the author to be a member of the group or able to see the event.
+// Returns the new post's id and the profiles it mentions.
+func insertPost(ctx context.Context, tx *sql.Tx, post Post) (int, []string, error) {
+    var group, event interface{}
+
+    if post.Poll != nil {
+        err := validatePoll(post.Poll)
+
+        if err != nil {
+            return 0, nil, err
+        }
+    }
+
+    if post.GroupUrl != "" {
+        err := requireRole(ctx, post.GroupUrl, post.AuthorUrl, RoleMember)
+
+        if err != nil {
+            return 0, nil, err
+        }
+
+        post.ProfileUrl = post.AuthorUrl
+        group = post.GroupUrl
+    } else if post.EventId != 0 {
+        _, _, err := eventAccess(ctx, strconv.Itoa(post.EventId), post.AuthorUrl)
+
+        if err != nil {
+            return 0, nil, err
+        }
+
+        post.ProfileUrl = post.AuthorUrl
+        event = post.EventId
+    }
+
+    query := `INSERT INTO post (profileurl, authorurl, content, groupurl, eventid)
+            VALUES ($1, $2, $3, $4, $5)
+            RETURNING id;`
+
+    var id int
+    err := tx.QueryRowContext(ctx, query, post.ProfileUrl, post.AuthorUrl, post.Content,
+            group, event).Scan(&id)
+
+    if err != nil {
+        return 0, nil, err
+    }
+
+    mentioned, err := saveEntities(ctx, tx, "postid", id, post.Content)
+
+    if err != nil {
+        return 0, nil, err
+    }
+
+    if post.Poll != nil {
+        err = savePoll(ctx, tx, id, post.Poll)
+
+        if err != nil {
+            return 0, nil, err
+        }
+    }
+
+    return id, mentioned, nil
+}
+
+// Moves user's post to the trash. sql.ErrNoRows if they didn't write it.
+func deletePost(ctx context.Context, id string, user string) error {
+    ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+    defer cancel()
+
     log.Println("delete: "+id)
-    query := `DELETE FROM post
-            WHERE id = $1;`
+    query := `UPDATE post
+            SET deleted = now()
+            WHERE id = $1
+            AND authorurl = $2
+            AND deleted IS NULL;`
 
-    _, err := db.Exec(query, id)
+    res, err := db.ExecContext(ctx, query, id, user)
+
+    if err != nil {
+        return err
+    }
+
+    if n, _ := res.RowsAffected(); n == 0 {
+        return sql.ErrNoRows
+    }
 
-    return err
+    return nil
 }
 
-func editPost(id string, content string) error {
+func editPost(ctx context.Context, id string, author string, content string) error {
+    ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+    defer cancel()
+
+    tx, err := db.BeginTx(ctx, nil)
+
+    if err != nil {
+        return err
+    }
+
+    defer tx.Rollback()
+
+    changed, err := saveRevision(ctx, tx, "post", id, author, content)
+
+    if err != nil || !changed {
+        return err
+    }
+
     query := `UPDATE post
-            SET content = $1
-            WHERE id = $2;`
+            SET content = $1, edited = now()
+            WHERE id = $2
+            RETURNING id;`
+
+    var postId int
+    err = tx.QueryRowContext(ctx, query, content, id).Scan(&postId)
+
+    if err != nil {
+        return err
+    }
+
+    mentioned, err := saveEntities(ctx, tx, "postid", postId, content)
+
+    if err != nil {
+        return err
+    }
+
+    err = tx.Commit()
+
+    if err != nil {
+        return err
+    }
 
-    _, err := db.Exec(query, content, id)
+    notifyMentions(ctx, mentioned, author, postId, 0)
+    warmPreview(ctx, content)
 
-    return err
+    return nil
 }
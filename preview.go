@@ -0,0 +1,476 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "github.com/lib/pq"
+    "html"
+    "io"
+    "log"
+    "mime"
+    "net"
+    "net/http"
+    "net/url"
+    "regexp"
+    "strings"
+    "sync"
+    "syscall"
+    "time"
+)
+
+const (
+    previewTimeout = 10 * time.Second
+    previewTTL = 7 * 24 * time.Hour
+    previewRetention = 30 * 24 * time.Hour
+    maxPreviewBody = 1 << 20
+    maxOEmbedBody = 64 << 10
+)
+
+var errPrivateAddress = errors.New("Link resolves to a private address")
+
+var (
+    linkPattern = regexp.MustCompile(`https?://[^\s<>"]+`)
+    titlePattern = regexp.MustCompile(`(?is)<title[^>]*>(.*?)</title>`)
+    tagPattern = regexp.MustCompile(`(?is)<(meta|link)\s[^>]*>`)
+    attrPattern = regexp.MustCompile(`(?s)([a-zA-Z:_-]+)\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s"'>]+))`)
+)
+
+// Metadata for the first link in a post, from its OpenGraph tags, falling
+// back to oEmbed and then the page title.
+type Preview struct {
+    URL         string      `json:"url"`
+    Title       string      `json:"title"`
+    Description string      `json:"description,omitempty"`
+    Image       string      `json:"image,omitempty"`
+    Site        string      `json:"site,omitempty"`
+}
+
+type PreviewFetcher interface {
+    Fetch(ctx context.Context, link string) (*Preview, error)
+}
+
+// Replaced with one pointed at a stub server when testing.
+var previewFetcher PreviewFetcher = newHTTPFetcher(false)
+
+// Links are only followed to public addresses unless allowPrivate is set.
+// The check is made on the address actually dialled, so redirects and DNS
+// answers that change between lookups can't get around it.
+type httpFetcher struct {
+    client *http.Client
+}
+
+func newHTTPFetcher(allowPrivate bool) *httpFetcher {
+    if allowPrivate {
+        return newGuardedFetcher(nil)
+    }
+
+    return newGuardedFetcher(publicAddress)
+}
+
+// A fetcher that only dials addresses allowed says it may, or any when
+// allowed is nil.
+func newGuardedFetcher(allowed func(net.IP) bool) *httpFetcher {
+    dialer := &net.Dialer{Timeout: previewTimeout}
+
+    if allowed != nil {
+        dialer.Control = func(network string, address string, c syscall.RawConn) error {
+            host, _, err := net.SplitHostPort(address)
+
+            if err != nil {
+                return err
+            }
+
+            if !allowed(net.ParseIP(host)) {
+                return errPrivateAddress
+            }
+
+            return nil
+        }
+    }
+
+    transport := &http.Transport{
+        Proxy: nil,
+        DialContext: dialer.DialContext,
+        TLSHandshakeTimeout: previewTimeout,
+        ResponseHeaderTimeout: previewTimeout,
+        MaxIdleConns: 10,
+        IdleConnTimeout: time.Minute,
+    }
+
+    client := &http.Client{
+        Transport: transport,
+        Timeout: previewTimeout,
+        CheckRedirect: func(req *http.Request, via []*http.Request) error {
+            if len(via) >= 5 {
+                return errors.New("Too many redirects")
+            }
+
+            if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+                return errors.New("Unsupported redirect")
+            }
+
+            return nil
+        },
+    }
+
+    return &httpFetcher{client}
+}
+
+func publicAddress(ip net.IP) bool {
+    if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+            ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+            ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+        return false
+    }
+
+    // Shared address space used for carrier-grade NAT, and "this network".
+    if ip4 := ip.To4(); ip4 != nil {
+        return !(ip4[0] == 100 && ip4[1] & 0xc0 == 64) && ip4[0] != 0
+    }
+
+    return true
+}
+
+func (f *httpFetcher) Fetch(ctx context.Context, link string) (*Preview, error) {
+    body, base, contentType, err := f.get(ctx, link, "text/html", maxPreviewBody)
+
+    if err != nil {
+        return nil, err
+    }
+
+    p := &Preview{URL: link, Site: base.Hostname()}
+
+    if strings.HasPrefix(contentType, "image/") {
+        p.Image = base.String()
+        return p, nil
+    }
+
+    if contentType != "text/html" && contentType != "application/xhtml+xml" {
+        return p, nil
+    }
+
+    var oembed string
+    meta := make(map[string]string)
+
+    for _, tag := range tagPattern.FindAllStringSubmatch(body, -1) {
+        attrs := make(map[string]string)
+
+        for _, a := range attrPattern.FindAllStringSubmatch(tag[0], -1) {
+            attrs[strings.ToLower(a[1])] = html.UnescapeString(a[2] + a[3] + a[4])
+        }
+
+        if strings.ToLower(tag[1]) == "link" {
+            if strings.EqualFold(attrs["type"], "application/json+oembed") && oembed == "" {
+                oembed = attrs["href"]
+            }
+
+            continue
+        }
+
+        name := strings.ToLower(attrs["property"])
+
+        if name == "" {
+            name = strings.ToLower(attrs["name"])
+        }
+
+        if _, seen := meta[name]; name != "" && !seen {
+            meta[name] = strings.TrimSpace(attrs["content"])
+        }
+    }
+
+    p.Title = firstOf(meta["og:title"], meta["twitter:title"])
+    p.Description = firstOf(meta["og:description"], meta["twitter:description"], meta["description"])
+    p.Image = firstOf(meta["og:image"], meta["twitter:image"])
+    p.Site = firstOf(meta["og:site_name"], p.Site)
+
+    if (p.Title == "" || p.Image == "") && oembed != "" {
+        f.addOEmbed(ctx, p, base, oembed)
+    }
+
+    if p.Title == "" {
+        if m := titlePattern.FindStringSubmatch(body); m != nil {
+            p.Title = strings.TrimSpace(html.UnescapeString(m[1]))
+        }
+    }
+
+    if p.Image != "" {
+        p.Image = imageLink(base, p.Image)
+    }
+
+    return p, nil
+}
+
+// oEmbed only fills in what the page's own tags left out, and a failure
+// just leaves the preview as it was.
+func (f *httpFetcher) addOEmbed(ctx context.Context, p *Preview, base *url.URL, link string) {
+    body, _, _, err := f.get(ctx, resolveLink(base, link), "application/json", maxOEmbedBody)
+
+    if err != nil {
+        log.Println("oEmbed " + link + ": " + err.Error())
+        return
+    }
+
+    var o struct {
+        Title           string  `json:"title"`
+        ProviderName    string  `json:"provider_name"`
+        ThumbnailUrl    string  `json:"thumbnail_url"`
+    }
+
+    if json.Unmarshal([]byte(body), &o) != nil {
+        return
+    }
+
+    p.Title = firstOf(p.Title, o.Title)
+    p.Image = firstOf(p.Image, o.ThumbnailUrl)
+
+    if o.ProviderName != "" && p.Site == base.Hostname() {
+        p.Site = o.ProviderName
+    }
+}
+
+// Returns up to limit bytes of the body, the final URL after redirects and
+// the media type.
+func (f *httpFetcher) get(ctx context.Context, link string, accept string, limit int64) (string, *url.URL, string, error) {
+    req, err := http.NewRequestWithContext(ctx, "GET", link, nil)
+
+    if err != nil {
+        return "", nil, "", err
+    }
+
+    if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+        return "", nil, "", errors.New("Unsupported link")
+    }
+
+    req.Header.Set("Accept", accept)
+    req.Header.Set("User-Agent", "netwrk-preview/1.0")
+
+    resp, err := f.client.Do(req)
+
+    if err != nil {
+        return "", nil, "", err
+    }
+
+    defer resp.Body.Close()
+
+    if resp.StatusCode != http.StatusOK {
+        return "", nil, "", errors.New("Fetching " + link + ": " + resp.Status)
+    }
+
+    contentType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+    body, err := io.ReadAll(io.LimitReader(resp.Body, limit))
+
+    if err != nil {
+        return "", nil, "", err
+    }
+
+    return string(body), resp.Request.URL, contentType, nil
+}
+
+func resolveLink(base *url.URL, link string) string {
+    ref, err := url.Parse(link)
+
+    if err != nil {
+        return ""
+    }
+
+    return base.ResolveReference(ref).String()
+}
+
+// Images are shown to other users, so only web links are kept.
+func imageLink(base *url.URL, link string) string {
+    resolved, err := url.Parse(resolveLink(base, link))
+
+    if err != nil || (resolved.Scheme != "http" && resolved.Scheme != "https") {
+        return ""
+    }
+
+    return resolved.String()
+}
+
+func firstOf(values ...string) string {
+    for _, v := range values {
+        if v != "" {
+            return v
+        }
+    }
+
+    return ""
+}
+
+// The first link in some content, without any punctuation ending the
+// sentence around it. Closing brackets are kept when the link opened them.
+func firstLink(content string) string {
+    link := linkPattern.FindString(content)
+
+    for link != "" {
+        last := link[len(link) - 1]
+
+        if strings.IndexByte(".,;:!?'", last) < 0 &&
+                !(last == ')' && strings.Count(link, "(") < strings.Count(link, ")")) &&
+                !(last == ']' && strings.Count(link, "[") < strings.Count(link, "]")) {
+            break
+        }
+
+        link = link[:len(link) - 1]
+    }
+
+    return link
+}
+
+// Cached previews for the given links. Links that have never been fetched,
+// or whose previews are stale, are fetched in the background so a later
+// read has them.
+func loadPreviews(ctx context.Context, links []string) (map[string]*Preview, error) {
+    query := `SELECT url, title, description, image, site, failed, fetched
+            FROM preview
+            WHERE url = ANY($1);`
+
+    rows, err := db.QueryContext(ctx, query, pq.Array(links))
+
+    if err != nil {
+        return nil, err
+    }
+
+    defer rows.Close()
+
+    previews := make(map[string]*Preview)
+    cached := make(map[string]bool)
+
+    for rows.Next() {
+        var p Preview
+        var failed bool
+        var fetched time.Time
+        err = rows.Scan(&p.URL, &p.Title, &p.Description, &p.Image, &p.Site, &failed, &fetched)
+
+        if err != nil {
+            return nil, err
+        }
+
+        if time.Since(fetched) < previewTTL {
+            cached[p.URL] = true
+        }
+
+        if !failed {
+            previews[p.URL] = &p
+        }
+    }
+
+    if err = rows.Err(); err != nil {
+        return nil, err
+    }
+
+    for _, link := range links {
+        if !cached[link] {
+            go refreshPreview(link)
+        }
+    }
+
+    return previews, nil
+}
+
+var previewsInFlight = struct {
+    sync.Mutex
+    links map[string]bool
+}{links: make(map[string]bool)}
+
+// Fetches a preview and caches it, recording failures too so a broken link
+// isn't fetched on every read.
+func refreshPreview(link string) {
+    if link == "" {
+        return
+    }
+
+    previewsInFlight.Lock()
+
+    if previewsInFlight.links[link] {
+        previewsInFlight.Unlock()
+        return
+    }
+
+    previewsInFlight.links[link] = true
+    previewsInFlight.Unlock()
+
+    defer func() {
+        previewsInFlight.Lock()
+        delete(previewsInFlight.links, link)
+        previewsInFlight.Unlock()
+    }()
+
+    ctx, cancel := context.WithTimeout(context.Background(), previewTimeout)
+    defer cancel()
+
+    p, err := previewFetcher.Fetch(ctx, link)
+    failed := err != nil
+
+    if failed {
+        log.Println("Preview " + link + ": " + err.Error())
+        p = &Preview{URL: link}
+    }
+
+    ctx, cancel = context.WithTimeout(context.Background(), queryTimeout)
+    defer cancel()
+
+    query := `INSERT INTO preview (url, title, description, image, site, failed)
+            VALUES ($1, $2, $3, $4, $5, $6)
+            ON CONFLICT (url) DO UPDATE
+            SET title = $2, description = $3, image = $4, site = $5, failed = $6,
+                fetched = now();`
+
+    _, err = db.ExecContext(ctx, query, link, p.Title, p.Description, p.Image, p.Site, failed)
+
+    if err != nil {
+        log.Println("Preview " + link + ": " + err.Error())
+    }
+}
+
+// Starts fetching the preview for new or edited content unless it is
+// already cached.
+func warmPreview(ctx context.Context, content string) {
+    if link := firstLink(content); link != "" {
+        _, err := loadPreviews(ctx, []string{link})
+
+        if err != nil {
+            log.Println("Preview " + link + ": " + err.Error())
+        }
+    }
+}
+
+// Attaches cached previews to posts that contain a link.
+func addPreviews(ctx context.Context, posts []*Post) error {
+    var links []string
+
+    for _, post := range posts {
+        if link := firstLink(post.Content); link != "" {
+            links = append(links, link)
+        }
+    }
+
+    if len(links) == 0 {
+        return nil
+    }
+
+    previews, err := loadPreviews(ctx, links)
+
+    if err != nil {
+        return err
+    }
+
+    for _, post := range posts {
+        post.Preview = previews[firstLink(post.Content)]
+    }
+
+    return nil
+}
+
+func purgeStalePreviews(ctx context.Context) error {
+    ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+    defer cancel()
+
+    query := `DELETE FROM preview
+            WHERE fetched < $1;`
+
+    _, err := db.ExecContext(ctx, query, time.Now().Add(-previewRetention))
+
+    return err
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+    "context"
+    "errors"
+    "net"
+    "net/http"
+    "net/http/httptest"
+    "testing"
+)
+
+func TestPublicAddress(t *testing.T) {
+    tests := []struct {
+        ip      string
+        public  bool
+    }{
+        {"93.184.216.34", true},
+        {"2606:2800:220:1:248:1893:25c8:1946", true},
+        {"127.0.0.1", false},
+        {"::1", false},
+        {"10.1.2.3", false},
+        {"172.16.0.1", false},
+        {"192.168.1.1", false},
+        {"169.254.169.254", false},
+        {"100.64.0.1", false},
+        {"0.0.0.0", false},
+        {"0.1.2.3", false},
+        {"fc00::1", false},
+        {"fe80::1", false},
+        {"224.0.0.1", false},
+        {"::ffff:127.0.0.1", false},
+        {"::ffff:10.0.0.1", false},
+    }
+
+    for _, test := range tests {
+        if got := publicAddress(net.ParseIP(test.ip)); got != test.public {
+            t.Errorf("publicAddress(%s) = %v, want %v", test.ip, got, test.public)
+        }
+    }
+
+    if publicAddress(nil) {
+        t.Error("publicAddress(nil) = true, want false")
+    }
+}
+
+func TestFetchRefusesPrivateAddresses(t *testing.T) {
+    server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Type", "text/html")
+        w.Write([]byte("<title>Internal</title>"))
+    }))
+    defer server.Close()
+
+    _, err := newHTTPFetcher(false).Fetch(context.Background(), server.URL)
+
+    if !errors.Is(err, errPrivateAddress) {
+        t.Fatalf("Fetch of a loopback address: got %v, want %v", err, errPrivateAddress)
+    }
+}
+
+// 127.0.0.1 stands in for a public address and 127.0.0.2 for a private one.
+func TestFetchRefusesRedirectsToPrivateAddresses(t *testing.T) {
+    private := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Type", "text/html")
+        w.Write([]byte("<title>Internal</title>"))
+    }))
+
+    listener, err := net.Listen("tcp", "127.0.0.2:0")
+
+    if err != nil {
+        t.Skip("Can't listen on 127.0.0.2:", err)
+    }
+
+    private.Listener.Close()
+    private.Listener = listener
+    private.Start()
+    defer private.Close()
+
+    public := httptest.NewServer(http.RedirectHandler(private.URL, http.StatusFound))
+    defer public.Close()
+
+    allowed := func(ip net.IP) bool {
+        return ip.Equal(net.ParseIP("127.0.0.1"))
+    }
+
+    _, err = newGuardedFetcher(allowed).Fetch(context.Background(), public.URL)
+
+    if !errors.Is(err, errPrivateAddress) {
+        t.Fatalf("Fetch redirected to a private address: got %v, want %v", err, errPrivateAddress)
+    }
+}
+
+func TestFetchRefusesOtherSchemes(t *testing.T) {
+    server := httptest.NewServer(http.RedirectHandler("file:///etc/passwd", http.StatusFound))
+    defer server.Close()
+
+    f := newHTTPFetcher(true)
+
+    if _, err := f.Fetch(context.Background(), server.URL); err == nil {
+        t.Error("Fetch followed a redirect to a file: link")
+    }
+
+    if _, err := f.Fetch(context.Background(), "ftp://example.com/"); err == nil {
+        t.Error("Fetch accepted an ftp: link")
+    }
+}
+
+func TestFetchParsesMetadata(t *testing.T) {
+    pages := map[string]string{
+        "/og": `<html><head>
+            <meta property="og:title" content="Tom &amp; Jerry">
+            <meta property="og:title" content="Ignored">
+            <meta name="description" content="Plain description">
+            <meta property='og:description' content='Cat and mouse'>
+            <meta content="/img/poster.png" property="og:image">
+            <meta property="og:site_name" content="Cartoons">
+            <title>Page title</title>
+            </head></html>`,
+        "/twitter": `<meta name="twitter:title" content="Tweeted">
+            <meta name="twitter:image" content="https://cdn.example.com/t.png">`,
+        "/title": `<html><head><title>
+            Just a title &lt;3
+            </title></head></html>`,
+        "/script": `<meta property="og:title" content="Sneaky">
+            <meta property="og:image" content="javascript:alert(1)">`,
+        "/data": `<meta property="og:title" content="Inline">
+            <meta property="og:image" content="data:image/png;base64,AAAA">`,
+        "/oembed": `<title>Fallback</title>
+            <link rel="alternate" type="application/json+oembed" href="/oembed.json">`,
+    }
+
+    server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        switch r.URL.Path {
+        case "/oembed.json":
+            w.Header().Set("Content-Type", "application/json")
+            w.Write([]byte(`{"title": "Embedded", "provider_name": "Videos",
+                "thumbnail_url": "/thumb.jpg"}`))
+        case "/image.png":
+            w.Header().Set("Content-Type", "image/png")
+            w.Write([]byte("\x89PNG"))
+        default:
+            page, ok := pages[r.URL.Path]
+
+            if !ok {
+                http.NotFound(w, r)
+                return
+            }
+
+            w.Header().Set("Content-Type", "text/html; charset=utf-8")
+            w.Write([]byte(page))
+        }
+    }))
+    defer server.Close()
+
+    tests := []struct {
+        path    string
+        want    Preview
+    }{
+        {"/og", Preview{Title: "Tom & Jerry", Description: "Cat and mouse",
+                Image: server.URL + "/img/poster.png", Site: "Cartoons"}},
+        {"/twitter", Preview{Title: "Tweeted", Image: "https://cdn.example.com/t.png",
+                Site: "127.0.0.1"}},
+        {"/title", Preview{Title: "Just a title <3", Site: "127.0.0.1"}},
+        {"/script", Preview{Title: "Sneaky", Site: "127.0.0.1"}},
+        {"/data", Preview{Title: "Inline", Site: "127.0.0.1"}},
+        {"/oembed", Preview{Title: "Embedded", Image: server.URL + "/thumb.jpg", Site: "Videos"}},
+        {"/image.png", Preview{Image: server.URL + "/image.png", Site: "127.0.0.1"}},
+    }
+
+    f := newHTTPFetcher(true)
+
+    for _, test := range tests {
+        link := server.URL + test.path
+        test.want.URL = link
+
+        p, err := f.Fetch(context.Background(), link)
+
+        if err != nil {
+            t.Errorf("Fetch(%s): %v", test.path, err)
+            continue
+        }
+
+        if *p != test.want {
+            t.Errorf("Fetch(%s) = %+v, want %+v", test.path, *p, test.want)
+        }
+    }
+
+    if _, err := f.Fetch(context.Background(), server.URL + "/missing"); err == nil {
+        t.Error("Fetch of a missing page succeeded")
+    }
+}
+
+func TestFirstLink(t *testing.T) {
+    tests := []struct {
+        content string
+        link    string
+    }{
+        {"No links here", ""},
+        {"See https://example.com/a.", "https://example.com/a"},
+        {"Two: http://a.example, http://b.example", "http://a.example"},
+        {"(https://example.com/page)", "https://example.com/page"},
+        {"https://en.wikipedia.org/wiki/Go_(game)!", "https://en.wikipedia.org/wiki/Go_(game)"},
+        {"<a href=\"https://example.com/q?x=1\">", "https://example.com/q?x=1"},
+        {"javascript:alert(1)", ""},
+    }
+
+    for _, test := range tests {
+        if got := firstLink(test.content); got != test.link {
+            t.Errorf("firstLink(%q) = %q, want %q", test.content, got, test.link)
+        }
+    }
+}
@@ -1,6 +1,9 @@
 package main
 
 import (
+    "context"
+    "errors"
+    "io"
     "net/http"
     "github.com/gorilla/mux"
     "database/sql"
@@ -8,17 +11,37 @@ import (
     "log"
     "encoding/json"
     "time"
-    "regexp"
 )
 
-var connectPath = regexp.MustCompile("^(request|accept|delete|modify)/?$")
-
 type Profile struct {
     FirstName   string      `json:"firstname"`
     LastName    string      `json:"lastname"`
     Email       string      `json:"email"`
     DOB         time.Time   `json:"dob"`
     Bio         string      `json:"bio"`
+    Private     bool        `json:"private"`
+    Connections int         `json:"connections"`
+    Followers   int         `json:"followers"`
+}
+
+// Relationship types a connection can have. FromDesc and ToDesc describe
+// each side's role and may differ, e.g. "parent" and "child" for family.
+const (
+    RelFriend = "friend"
+    RelFamily = "family"
+    RelColleague = "colleague"
+    RelPartner = "partner"
+    RelCustom = "custom"
+)
+
+const maxDescriptorLength = 32
+
+var relationshipTypes = map[string]bool{
+    RelFriend: true,
+    RelFamily: true,
+    RelColleague: true,
+    RelPartner: true,
+    RelCustom: true,
 }
 
 type Connection struct {
@@ -26,6 +49,24 @@ type Connection struct {
     ToUrl       string      `json:"toUrl"`
     FromDesc    string      `json:"fromDesc"`
     ToDesc      string      `json:"toDesc"`
+    Type        string      `json:"type"`
+}
+
+const RequestsPerPage int = 20
+
+type PendingRequest struct {
+    URL         string      `json:"url"`
+    FirstName   string      `json:"firstname"`
+    LastName    string      `json:"lastname"`
+    Type        string      `json:"type"`
+    Requested   time.Time   `json:"requested"`
+}
+
+type Friend struct {
+    URL         string      `json:"url"`
+    P           Profile     `json:"profile"`
+    Type        string      `json:"type"`
+    Descriptor  string      `json:"descriptor"`
 }
 
 func profileHandler(w http.ResponseWriter, r *http.Request) {
@@ -35,7 +76,7 @@ func profileHandler(w http.ResponseWriter, r *http.Request) {
 
     switch action {
     case "get":
-        p, err := loadProfile(url)
+        p, err := loadProfile(r.Context(), url)
 
         if err != nil {
             if err == sql.ErrNoRows {
@@ -69,7 +110,7 @@ func profileHandler(w http.ResponseWriter, r *http.Request) {
             return
         }
 
-        err = createProfile(url, p)
+        err = createProfile(r.Context(), url, p)
 
         if err != nil {
             http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -86,7 +127,7 @@ func profileHandler(w http.ResponseWriter, r *http.Request) {
         var p Profile
         err := json.NewDecoder(r.Body).Decode(&p)
 
-        err = deleteProfile(url)
+        err = deleteProfile(r.Context(), url)
 
         if err != nil {
             http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -100,7 +141,16 @@ func profileHandler(w http.ResponseWriter, r *http.Request) {
             return
         }
 
-        var p Profile
+        if !checkProfileOwner(w, r, url) {
+            return
+        }
+
+        // Private is left as it is when the request doesn't give it
+        var p struct {
+            Profile
+            Private *bool `json:"private"`
+        }
+
         err := json.NewDecoder(r.Body).Decode(&p)
 
         if err != nil {
@@ -108,7 +158,7 @@ func profileHandler(w http.ResponseWriter, r *http.Request) {
             return
         }
 
-        err = modifyProfile(url, p)
+        err = modifyProfile(r.Context(), url, p.Profile, p.Private)
 
         if err != nil {
             http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -129,18 +179,40 @@ func connectionHandler(w http.ResponseWriter, r *http.Request) {
     p1 := vars["p1"]
     p2 := vars["p2"]
 
-    //var c Connection
-    //err := json.NewDecoder(r.Body).Decode(&c)
-
-    //if err != nil {
-      //  http.Error(w, err.Error(), http.StatusBadRequest)
-       // return
-   // }
+    // Requests and modifications may carry the proposed relationship, with
+    // FromDesc describing p1 and ToDesc describing p2. Without one the
+    // connection is a friendship.
+    var c Connection
     var err error
+
+    if action == "request" || action == "modify" {
+        err = json.NewDecoder(r.Body).Decode(&c)
+
+        if err == nil || err == io.EOF {
+            err = normaliseRelationship(&c)
+        }
+
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusBadRequest)
+            return
+        }
+    }
+
+    // p1 acts in every change: it requests, accepts, declines, cancels or
+    // removes the connection with p2, proposes or confirms its relationship,
+    // or blocks or unblocks p2
+    switch action {
+    case "request", "accept", "decline", "cancel", "delete", "modify", "confirm",
+            "block", "unblock":
+        if !checkProfileOwner(w, r, p1) {
+            return
+        }
+    }
+
     switch action {
     case "get":
         log.Println("connection check!")
-        exists, accepted, requestedBy := connectionExists(p1,p2)
+        exists, accepted, requestedBy := connectionExists(r.Context(), p1,p2)
         
         if exists {
             log.Println("exists")
@@ -164,42 +236,97 @@ func connectionHandler(w http.ResponseWriter, r *http.Request) {
             return
         }
     case "request":
-        err = requestConnection(p1, p2)
+        err = requestConnection(r.Context(), p1, p2, c)
+
+        if err == nil {
+            connectionRequests.Inc()
+        }
     case "accept":
-        err = acceptConnection(p1, p2)
+        err = acceptConnection(r.Context(), p1, p2)
+    case "decline":
+        err = declineConnection(r.Context(), p1, p2)
+    case "cancel":
+        err = cancelConnection(r.Context(), p1, p2)
     case "delete":
-        err = deleteConnection(p1, p2)
+        err = deleteConnection(r.Context(), p1, p2)
     case "modify":
-        err = modifyConnection(p1, p2)
+        err = modifyConnection(r.Context(), p1, p2, c)
+    case "confirm":
+        err = confirmRelationship(r.Context(), p1, p2)
+    case "block":
+        err = blockProfile(r.Context(), p1, p2)
+    case "unblock":
+        err = unblockProfile(r.Context(), p1, p2)
+    case "mutual":
+        var mutual []Result
+        mutual, err = mutualConnections(r.Context(), p1, p2)
+
+        if err == nil {
+            err = json.NewEncoder(w).Encode(mutual)
+        }
+    case "degree":
+        var sep *Separation
+        sep, err = separation(r.Context(), p1, p2)
+
+        if err == nil {
+            err = json.NewEncoder(w).Encode(sep)
+        }
     default:
         http.NotFound(w, r)
         return
     }
 
+    if err == sql.ErrNoRows {
+        http.NotFound(w, r)
+        return
+    }
+
+    if err == errNotPermitted {
+        http.Error(w, err.Error(), http.StatusForbidden)
+        return
+    }
+
     if err != nil {
         http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    switch action {
+    case "request", "accept", "cancel", "delete", "block", "unblock":
+        invalidateSuggestions(r.Context(), p1, p2)
+    }
+
+    switch action {
+    case "accept", "delete", "block":
+        invalidateTimelines(r.Context(), p1, p2)
     }
 
+    switch action {
+    case "accept", "delete", "block", "modify", "confirm":
+        invalidateProfiles(p1, p2)
+    }
 }
 
 func checkUrlHandler(w http.ResponseWriter, r *http.Request) {
     vars := mux.Vars(r)
     url := vars["url"]
 
-    query := `SELECT url 
-              FROM profile
-              WHERE url = $1;`
+    var available bool
+
+    err := readThrough(urlKey(url), profileTTL, &available, func() (interface{}, error) {
+        query := `SELECT NOT EXISTS (SELECT *
+                    FROM profile
+                    WHERE url = $1);`
 
-    err := db.QueryRow(query, url).Scan(&url)
-    var available = false
+        var free bool
+        err := db.QueryRowContext(r.Context(), query, url).Scan(&free)
+
+        return free, err
+    })
 
     if err != nil {
-        if err == sql.ErrNoRows {
-            available = true
-        } else {
-            http.Error(w, err.Error(), http.StatusInternalServerError)
-            return
-        }
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
     }
 
     err = json.NewEncoder(w).Encode(
@@ -218,7 +345,7 @@ func friendListHandler(w http.ResponseWriter, r *http.Request) {
     vars := mux.Vars(r)
     url := vars["url"]
 
-    friends, err := loadFriends(url)
+    friends, err := loadFriends(r.Context(), url, r.URL.Query().Get("type"))
 
     if err != nil {
         http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -233,15 +360,78 @@ func friendListHandler(w http.ResponseWriter, r *http.Request) {
     }
 }
 
-func loadProfile(url string) (*Profile, error) {
+// Lists pending requests to (incoming) or from (outgoing) a profile, newest
+// first, in pages of RequestsPerPage before the optional "before" time.
+func pendingRequestHandler(w http.ResponseWriter, r *http.Request) {
+    vars := mux.Vars(r)
+    box := vars["box"]
+    url := vars["url"]
+
+    var before time.Time
+
+    if b := r.URL.Query().Get("before"); b != "" {
+        var err error
+        before, err = time.Parse(time.RFC3339Nano, b)
+
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusBadRequest)
+            return
+        }
+    }
+
+    if box != "incoming" && box != "outgoing" {
+        http.NotFound(w, r)
+        return
+    }
+
+    if !checkProfileOwner(w, r, url) {
+        return
+    }
+
+    requests, err := loadPendingRequests(r.Context(), url, box == "incoming", before)
+
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    err = json.NewEncoder(w).Encode(requests)
+
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+    }
+}
+
+func profileUrlForEmail(ctx context.Context, email string) (string, error) {
+    var url string
+
+    err := readThrough(emailKey(email), profileTTL, &url, func() (interface{}, error) {
+        return queryProfileUrl(ctx, email)
+    })
+
+    return url, err
+}
 
-    query := `SELECT firstname, lastname, email, dob, bio
+func queryProfileUrl(ctx context.Context, email string) (string, error) {
+    ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+    defer cancel()
+
+    query := `SELECT url
             FROM profile
-            WHERE url = $1;`
+            WHERE email = $1;`
+
+    var url string
+    err := db.QueryRowContext(ctx, query, email).Scan(&url)
+
+    return url, err
+}
 
+func loadProfile(ctx context.Context, url string) (*Profile, error) {
     var p Profile
-    row := db.QueryRow(query, url)
-    err := row.Scan(&(p.FirstName), &(p.LastName), &(p.Email), &(p.DOB), &(p.Bio))
+
+    err := readThrough(profileKey(url), profileTTL, &p, func() (interface{}, error) {
+        return queryProfile(ctx, url)
+    })
 
     if err != nil {
         return nil, err
@@ -250,41 +440,84 @@ func loadProfile(url string) (*Profile, error) {
     return &p, nil
 }
 
-func loadFriends(userUrl string) ([]struct{
-        URL string  `json:"url"`
-        P Profile `json:"profile"`
-    }, error) {
+func queryProfile(ctx context.Context, url string) (*Profile, error) {
+    ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+    defer cancel()
+
+    query := `SELECT firstname, lastname, email, dob, bio, private,
+                (SELECT COUNT(*)
+                FROM connection c
+                WHERE c.accepted
+                AND profile.url IN(c.fromurl, c.tourl)),
+                (SELECT COUNT(*)
+                FROM follow f
+                WHERE f.approved
+                AND f.followed = profile.url)
+            FROM profile
+            WHERE url = $1
+            AND NOT EXISTS (SELECT *
+                            FROM account a
+                            WHERE a.email = profile.email
+                            AND a.deactivated IS NOT NULL);`
+
+    var p Profile
+    row := db.QueryRowContext(ctx, query, url)
+    err := row.Scan(&(p.FirstName), &(p.LastName), &(p.Email), &(p.DOB), &(p.Bio),
+            &(p.Private), &(p.Connections), &(p.Followers))
 
-    var friends []struct{
-        URL string  `json:"url"`
-        P Profile `json:"profile"`
+    if err != nil {
+        return nil, err
     }
 
-    query := `SELECT friend.url, friend.firstname, friend.lastname, friend.email, friend.dob, friend.bio
-            FROM profile user, profile friend, connection c
-            WHERE user.url = $1
-            AND user.url IN(c.fromurl, c.tourl)
+    return &p, nil
+}
+
+// Lists a profile's connections, optionally only those of one relationship
+// type. Each friend's descriptor is their role in the relationship.
+func loadFriends(ctx context.Context, userUrl string, relType string) ([]Friend, error) {
+    var friends []Friend
+
+    err := readThrough(friendsKey(userUrl, relType), friendsTTL, &friends, func() (interface{}, error) {
+        return queryFriends(ctx, userUrl, relType)
+    })
+
+    return friends, err
+}
+
+func queryFriends(ctx context.Context, userUrl string, relType string) ([]Friend, error) {
+    ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+    defer cancel()
+
+    var friends []Friend
+
+    query := `SELECT friend.url, friend.firstname, friend.lastname, friend.email, friend.dob, friend.bio,
+                c.type,
+                CASE WHEN c.fromurl = friend.url THEN c.fromdescriptor ELSE c.todescriptor END
+            FROM profile usr, profile friend, connection c
+            WHERE usr.url = $1
+            AND usr.url IN(c.fromurl, c.tourl)
             AND friend.url IN(c.fromurl, c.tourl)
-            AND user.url <> friend.url;`
+            AND usr.url <> friend.url
+            AND c.accepted
+            AND ($2 = '' OR c.type = $2);`
 
-    rows, err := db.Query(query, userUrl)
+    rows, err := db.QueryContext(ctx, query, userUrl, relType)
 
     if err != nil {
         return nil, err
     }
 
     for rows.Next() {
-        var friend struct{
-            URL string  `json:"url"`
-            P Profile `json:"profile"`
-        }
+        var friend Friend
 
         err = rows.Scan(&friend.URL,
                 &friend.P.FirstName,
                 &friend.P.LastName,
                 &friend.P.Email,
                 &friend.P.DOB,
-                &friend.P.Bio)
+                &friend.P.Bio,
+                &friend.Type,
+                &friend.Descriptor)
         friends = append(friends, friend)
     }
 
@@ -295,38 +528,204 @@ func loadFriends(userUrl string) ([]struct{
     return friends, nil
 }
 
-func createProfile(url string, profile Profile) error {
-    query := `INSERT INTO profile (url, firstname, lastname, email, dob, bio)
-            VALUES ($1,$2, $3, $4, $5, $6);`
+func createProfile(ctx context.Context, url string, profile Profile) error {
+    ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+    defer cancel()
+
+    query := `INSERT INTO profile (url, firstname, lastname, email, dob, bio, private)
+            VALUES ($1,$2, $3, $4, $5, $6, $7);`
 
-    _, err := db.Exec(query, url, profile.FirstName, profile.LastName,
-            profile.Email, profile.DOB, profile.Bio)
+    _, err := db.ExecContext(ctx, query, url, profile.FirstName, profile.LastName,
+            profile.Email, profile.DOB, profile.Bio, profile.Private)
+
+    cache.Delete(urlKey(url), emailKey(profile.Email))
 
     return err
 }
 
-func deleteProfile(url string) error {
-    query := `DELETE FROM profile
-            WHERE url = $1;`
+func deleteProfile(ctx context.Context, url string) error {
+    ctx, cancel := context.WithTimeout(ctx, purgeTimeout)
+    defer cancel()
 
-    _, err := db.Exec(query, url)
+    tx, err := db.BeginTx(ctx, nil)
 
-    return err
+    if err != nil {
+        return err
+    }
+
+    err = purgeProfile(ctx, tx, url)
+
+    if err != nil {
+        tx.Rollback()
+        return err
+    }
+
+    return tx.Commit()
+}
+
+// Removes a profile along with everything written by it or on it. Dependants
+// go first: reactions, then comments, then posts.
+func purgeProfile(ctx context.Context, tx *sql.Tx, url string) error {
+    err := purgeEvents(ctx, tx, "ownerurl = $1", url)
+
+    if err != nil {
+        return err
+    }
+
+    err = handOverGroups(ctx, tx, url)
+
+    if err != nil {
+        return err
+    }
+
+    var email string
+    err = tx.QueryRowContext(ctx, `SELECT email FROM profile WHERE url = $1;`, url).Scan(&email)
+
+    if err != nil && err != sql.ErrNoRows {
+        return err
+    }
+
+    // Reactions it left change other posts' counts
+    var reacted []int
+
+    defer func() {
+        invalidateProfiles(url)
+        invalidateReactions(reacted...)
+        cache.Delete(urlKey(url), emailKey(email))
+    }()
+
+    query := `DELETE FROM reaction
+            WHERE authorurl = $1
+            OR (post = true
+                AND postid IN (SELECT id FROM post WHERE $1 IN(profileurl, authorurl)))
+            OR (post = false
+                AND commentid IN (SELECT c.id
+                                FROM comment c, post p
+                                WHERE c.postid = p.id
+                                AND (c.authorurl = $1
+                                    OR $1 IN(p.profileurl, p.authorurl))))
+            RETURNING post, COALESCE(postid, 0);`
+
+    reacted, err = deleteReactions(ctx, tx, query, url)
+
+    if err != nil {
+        return err
+    }
+
+    queries := []string{
+        `DELETE FROM comment
+            WHERE authorurl = $1
+            OR postid IN (SELECT id FROM post WHERE $1 IN(profileurl, authorurl));`,
+        `DELETE FROM post
+            WHERE $1 IN(profileurl, authorurl);`,
+        `DELETE FROM connection
+            WHERE $1 IN(fromurl, tourl);`,
+        `DELETE FROM block
+            WHERE $1 IN(blocker, blocked);`,
+        `DELETE FROM dismissal
+            WHERE $1 IN(url, dismissed);`,
+        `DELETE FROM follow
+            WHERE $1 IN(follower, followed);`,
+        `DELETE FROM membership
+            WHERE profileurl = $1;`,
+        `DELETE FROM attendee
+            WHERE profileurl = $1;`,
+        `DELETE FROM entity
+            WHERE kind = 'mention'
+            AND value = $1;`,
+        `DELETE FROM notification
+            WHERE $1 IN(profileurl, actorurl);`,
+        `DELETE FROM draft
+            WHERE $1 IN(authorurl, profileurl);`,
+        `DELETE FROM storyview
+            WHERE viewerurl = $1;`,
+        `DELETE FROM vote
+            WHERE voterurl = $1;`,
+        `DELETE FROM story
+            WHERE profileurl = $1;`,
+        `DELETE FROM search
+            WHERE resultUrl = $1;`,
+        `DELETE FROM timeline
+            WHERE owner = $1;`,
+        `DELETE FROM timelinestate
+            WHERE owner = $1;`,
+        `DELETE FROM profile
+            WHERE url = $1;`,
+    }
+
+    for _, query := range queries {
+        _, err := tx.ExecContext(ctx, query, url)
+
+        if err != nil {
+            return err
+        }
+    }
+
+    return nil
 }
 
-func modifyProfile(url string, profile Profile) error {
+// Updates a profile's details. Its privacy only changes when private is
+// given.
+func modifyProfile(ctx context.Context, url string, profile Profile, private *bool) error {
+    ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+    defer cancel()
 
-    query := `UPDATE profile
-            SET firstname = $1, lastname = $2, dob = $3, bio = $4
-            WHERE url = $5;`
+    tx, err := db.BeginTx(ctx, nil)
+
+    if err != nil {
+        return err
+    }
+
+    defer tx.Rollback()
+
+    var wasPrivate bool
+    query := `SELECT private
+            FROM profile
+            WHERE url = $1
+            FOR UPDATE;`
 
-    _, err := db.Exec(query, profile.FirstName, profile.LastName,
-            profile.DOB, profile.Bio, url)
+    err = tx.QueryRowContext(ctx, query, url).Scan(&wasPrivate)
+
+    if err != nil {
+        return err
+    }
+
+    query = `UPDATE profile
+            SET firstname = $1, lastname = $2, dob = $3, bio = $4,
+                private = COALESCE($5, private)
+            WHERE url = $6;`
+
+    _, err = tx.ExecContext(ctx, query, profile.FirstName, profile.LastName,
+            profile.DOB, profile.Bio, private, url)
+
+    if err != nil {
+        return err
+    }
+
+    // Anyone waiting on approval is let in once a profile goes public
+    if wasPrivate && private != nil && !*private {
+        query = `UPDATE follow
+                SET approved = true
+                WHERE followed = $1
+                AND NOT approved;`
+
+        _, err = tx.ExecContext(ctx, query, url)
+
+        if err != nil {
+            return err
+        }
+    }
+
+    err = tx.Commit()
+
+    invalidateProfiles(url)
 
     return err
 }
 
-func connectionExists(p1 string, p2 string) (bool, bool, string) {
+func connectionExists(ctx context.Context, p1 string, p2 string) (bool, bool, string) {
+    ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+    defer cancel()
 
     query := `SELECT c.accepted, c.fromurl
             FROM connection c
@@ -336,7 +735,7 @@ func connectionExists(p1 string, p2 string) (bool, bool, string) {
     var accepted bool
     var requestedBy string
 
-    err := db.QueryRow(query, p1, p2).Scan(&accepted, &requestedBy)
+    err := db.QueryRowContext(ctx, query, p1, p2).Scan(&accepted, &requestedBy)
 
     if err != nil {
         log.Println(err.Error());
@@ -346,43 +745,293 @@ func connectionExists(p1 string, p2 string) (bool, bool, string) {
     return true, accepted, requestedBy
 }
 
-func requestConnection(p1 string, p2 string) error {
-    query := `INSERT INTO connection (fromurl, tourl, fromdescriptor, todescriptor)
-            VALUES ($1, $2, $3, $4);`
+func normaliseRelationship(c *Connection) error {
+    if c.Type == "" {
+        c.Type = RelFriend
+    }
 
-    _, err := db.Exec(query, p1, p2, "friend", "friend")
+    if !relationshipTypes[c.Type] {
+        return errors.New("Unknown relationship type " + c.Type)
+    }
 
-    return err
+    if c.Type == RelCustom && (c.FromDesc == "" || c.ToDesc == "") {
+        return errors.New("Custom relationships need both descriptors")
+    }
+
+    if c.FromDesc == "" {
+        c.FromDesc = c.Type
+    }
+
+    if c.ToDesc == "" {
+        c.ToDesc = c.Type
+    }
+
+    if len(c.FromDesc) > maxDescriptorLength || len(c.ToDesc) > maxDescriptorLength {
+        return errors.New("Relationship descriptor too long")
+    }
+
+    return nil
+}
+
+// The relationship proposed with a request is agreed to when the request
+// is accepted. Profiles blocked either way can't request each other;
+// errNotPermitted then.
+func requestConnection(ctx context.Context, p1 string, p2 string, c Connection) error {
+    ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+    defer cancel()
+
+    query := `INSERT INTO connection (fromurl, tourl, fromdescriptor, todescriptor, type)
+            SELECT $1, $2, $3, $4, $5
+            WHERE NOT EXISTS (SELECT *
+                            FROM block b
+                            WHERE (b.blocker = $1 AND b.blocked = $2)
+                            OR (b.blocker = $2 AND b.blocked = $1));`
+
+    res, err := db.ExecContext(ctx, query, p1, p2, c.FromDesc, c.ToDesc, c.Type)
+
+    if err != nil {
+        return err
+    }
+
+    if n, _ := res.RowsAffected(); n == 0 {
+        return errNotPermitted
+    }
+
+    return nil
 }
 
-func acceptConnection(p1 string, p2 string) error {
-    query := `UPDATE connection 
+// p1 accepts the pending request p2 sent. sql.ErrNoRows if there is none.
+func acceptConnection(ctx context.Context, p1 string, p2 string) error {
+    ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+    defer cancel()
+
+    query := `UPDATE connection
             SET accepted = true
-            WHERE fromurl IN($1, $2)
-            AND tourl IN($1, $2);`
+            WHERE fromurl = $2
+            AND tourl = $1
+            AND NOT accepted
+            AND declined IS NULL;`
+
+    res, err := db.ExecContext(ctx, query, p1, p2)
+
+    if err != nil {
+        return err
+    }
+
+    if n, _ := res.RowsAffected(); n == 0 {
+        return sql.ErrNoRows
+    }
+
+    return nil
+}
+
+// p1 declines the request p2 sent. The request stays so p2 cannot
+// immediately send another, but no longer shows in p1's inbox.
+func declineConnection(ctx context.Context, p1 string, p2 string) error {
+    ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+    defer cancel()
+
+    query := `UPDATE connection
+            SET declined = now()
+            WHERE fromurl = $2
+            AND tourl = $1
+            AND NOT accepted;`
 
-    _, err := db.Exec(query, p1, p2);
+    _, err := db.ExecContext(ctx, query, p1, p2)
 
     return err
 }
 
-func deleteConnection(p1 string, p2 string) error {
+// p1 withdraws a request it sent to p2 that has not been accepted.
+func cancelConnection(ctx context.Context, p1 string, p2 string) error {
+    ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+    defer cancel()
+
+    query := `DELETE FROM connection
+            WHERE fromurl = $1
+            AND tourl = $2
+            AND NOT accepted;`
+
+    _, err := db.ExecContext(ctx, query, p1, p2)
+
+    return err
+}
+
+// Declined requests are left out of the incoming list but still show as
+// pending to the profile that sent them.
+func loadPendingRequests(ctx context.Context, url string, incoming bool, before time.Time) ([]PendingRequest, error) {
+    ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+    defer cancel()
+
+    var query string
+
+    if incoming {
+        query = `SELECT p.url, p.firstname, p.lastname, c.type, c.requested
+                FROM connection c, profile p
+                WHERE c.tourl = $1
+                AND p.url = c.fromurl
+                AND NOT c.accepted
+                AND c.declined IS NULL
+                AND ($2::timestamp IS NULL OR c.requested < $2)
+                ORDER BY c.requested DESC
+                LIMIT $3;`
+    } else {
+        query = `SELECT p.url, p.firstname, p.lastname, c.type, c.requested
+                FROM connection c, profile p
+                WHERE c.fromurl = $1
+                AND p.url = c.tourl
+                AND NOT c.accepted
+                AND ($2::timestamp IS NULL OR c.requested < $2)
+                ORDER BY c.requested DESC
+                LIMIT $3;`
+    }
+
+    var cursor interface{}
+
+    if !before.IsZero() {
+        cursor = before
+    }
+
+    rows, err := db.QueryContext(ctx, query, url, cursor, RequestsPerPage)
+
+    if err != nil {
+        return nil, err
+    }
+
+    defer rows.Close()
+
+    requests := []PendingRequest{}
+
+    for rows.Next() {
+        var req PendingRequest
+        err = rows.Scan(&req.URL, &req.FirstName, &req.LastName, &req.Type, &req.Requested)
+
+        if err != nil {
+            return nil, err
+        }
+
+        requests = append(requests, req)
+    }
+
+    return requests, rows.Err()
+}
+
+func deleteConnection(ctx context.Context, p1 string, p2 string) error {
+    ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+    defer cancel()
+
     query := `DELETE FROM connection
             WHERE fromurl IN($1, $2)
             AND tourl IN($1, $2);`
 
-    _, err := db.Exec(query, p1, p2);
+    _, err := db.ExecContext(ctx, query, p1, p2);
 
     return err
 }
 
-func modifyConnection(p1 string, p2 string) error {
+// Proposes a new relationship on an existing connection, which takes effect
+// once the other profile confirms it. Descriptors are swapped when the
+// connection was originally requested by p2.
+func modifyConnection(ctx context.Context, p1 string, p2 string, c Connection) error {
+    ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+    defer cancel()
+
     query := `UPDATE connection
-            SET fromdescriptor = $1, todescriptor = $2
-            WHERE fromurl = $3 
-            AND tourl = $4;`
+            SET proposedtype = $1,
+                proposedfromdesc = CASE WHEN fromurl = $4 THEN $2 ELSE $3 END,
+                proposedtodesc = CASE WHEN fromurl = $4 THEN $3 ELSE $2 END,
+                proposedby = $4
+            WHERE fromurl IN($4, $5)
+            AND tourl IN($4, $5);`
+
+    _, err := db.ExecContext(ctx, query, c.Type, c.FromDesc, c.ToDesc, p1, p2)
+
+    return err
+}
+
+// Applies the relationship p2 proposed to p1.
+func confirmRelationship(ctx context.Context, p1 string, p2 string) error {
+    ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+    defer cancel()
+
+    query := `UPDATE connection
+            SET type = proposedtype,
+                fromdescriptor = proposedfromdesc,
+                todescriptor = proposedtodesc,
+                proposedtype = NULL,
+                proposedfromdesc = NULL,
+                proposedtodesc = NULL,
+                proposedby = NULL
+            WHERE fromurl IN($1, $2)
+            AND tourl IN($1, $2)
+            AND proposedby = $2;`
+
+    res, err := db.ExecContext(ctx, query, p1, p2)
+
+    if err != nil {
+        return err
+    }
+
+    n, err := res.RowsAffected()
+
+    if err == nil && n == 0 {
+        err = errors.New("No relationship change proposed")
+    }
+
+    return err
+}
+
+// Blocking removes any connection or follow between the two profiles and
+// hides each from the other's searches.
+func blockProfile(ctx context.Context, blocker string, blocked string) error {
+    ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+    defer cancel()
+
+    tx, err := db.BeginTx(ctx, nil)
+
+    if err != nil {
+        return err
+    }
+
+    query := `INSERT INTO block (blocker, blocked)
+            VALUES ($1, $2)
+            ON CONFLICT DO NOTHING;`
+
+    _, err = tx.ExecContext(ctx, query, blocker, blocked)
+
+    if err == nil {
+        query = `DELETE FROM connection
+                WHERE fromurl IN($1, $2)
+                AND tourl IN($1, $2);`
+
+        _, err = tx.ExecContext(ctx, query, blocker, blocked)
+    }
+
+    if err == nil {
+        query = `DELETE FROM follow
+                WHERE follower IN($1, $2)
+                AND followed IN($1, $2);`
+
+        _, err = tx.ExecContext(ctx, query, blocker, blocked)
+    }
+
+    if err != nil {
+        tx.Rollback()
+        return err
+    }
+
+    return tx.Commit()
+}
+
+func unblockProfile(ctx context.Context, blocker string, blocked string) error {
+    ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+    defer cancel()
+
+    query := `DELETE FROM block
+            WHERE blocker = $1
+            AND blocked = $2;`
 
-    _, err := db.Exec(query, "friend", "friend", p1, p2)
+    _, err := db.ExecContext(ctx, query, blocker, blocked)
 
     return err
 }
@@ -0,0 +1,256 @@
+package main
+
+import (
+    "context"
+    "github.com/lib/pq"
+    "math"
+    "sort"
+    "time"
+)
+
+// The ranked feed scores the newest RankCandidates posts and pages through
+// them best first, RankedPages pages in all. Pages past that are empty.
+const (
+    RankedPages int = 10
+    RankCandidates int = RankedPages * PostsPerRequest
+)
+
+// What a scorer knows about a post. Age is measured from a fixed time
+// passed in, so the same signals always give the same score.
+type PostSignals struct {
+    Age         time.Duration
+    Affinity    int
+    Comments    int
+    Reactions   int
+    Shares      int
+    Poll        bool
+    Share       bool
+    Link        bool
+    Group       bool
+}
+
+type Scorer interface {
+    Score(s PostSignals) float64
+}
+
+// Decays a post's score with age, halving every HalfLife, and raises it
+// with the viewer's history of comments and reactions on the author's
+// posts, with engagement, and by content type. Counts are taken on a log
+// scale so a few very busy posts don't swamp the rest.
+type WeightedScorer struct {
+    HalfLife    time.Duration
+    Affinity    float64
+    Engagement  float64
+    Poll        float64
+    Share       float64
+    Link        float64
+    Group       float64
+}
+
+var DefaultScorer = WeightedScorer{
+    HalfLife: 12 * time.Hour,
+    Affinity: 0.5,
+    Engagement: 0.3,
+    Poll: 0.2,
+    Share: -0.1,
+    Link: 0.1,
+    Group: 0,
+}
+
+var feedScorer Scorer = DefaultScorer
+
+func (w WeightedScorer) Score(s PostSignals) float64 {
+    recency := math.Exp2(-float64(s.Age) / float64(w.HalfLife))
+    engagement := float64(2 * s.Comments + s.Reactions + 3 * s.Shares)
+
+    boost := 1 + w.Affinity * math.Log1p(float64(s.Affinity)) +
+            w.Engagement * math.Log1p(engagement)
+
+    for _, t := range []struct {
+        is      bool
+        weight  float64
+    }{{s.Poll, w.Poll}, {s.Share, w.Share}, {s.Link, w.Link}, {s.Group, w.Group}} {
+        if t.is {
+            boost += t.weight
+        }
+    }
+
+    return recency * math.Max(boost, 0)
+}
+
+// Orders posts best first. Ties go to the newer post, then the higher id,
+// so the order is stable between requests.
+func rankPosts(posts []Post, signals map[int]PostSignals, scorer Scorer) []Post {
+    scores := make(map[int]float64, len(posts))
+
+    for _, post := range posts {
+        scores[post.ID] = scorer.Score(signals[post.ID])
+    }
+
+    ranked := append([]Post(nil), posts...)
+
+    sort.SliceStable(ranked, func(i, j int) bool {
+        a, b := ranked[i], ranked[j]
+
+        if scores[a.ID] != scores[b.ID] {
+            return scores[a.ID] > scores[b.ID]
+        }
+
+        if !a.Timestamp.Equal(b.Timestamp) {
+            return a.Timestamp.After(b.Timestamp)
+        }
+
+        return a.ID > b.ID
+    })
+
+    return ranked
+}
+
+// A page of the ranked feed. Posts are ranked as of req.Before, so paging
+// with the same Before gives the same order apart from posts whose
+// engagement changed in between; clients should drop ids they've already
+// shown. Without Before only the first page is stable, ranked as of now.
+func getRankedPosts(ctx context.Context, req FeedRequest, viewer string) ([]Post, error) {
+    now := req.Before
+
+    if now.IsZero() {
+        now = time.Now()
+    }
+
+    candidates, err := getFriendPosts(ctx, viewer, now, req.Relationship, RankCandidates)
+
+    if err != nil {
+        return nil, err
+    }
+
+    signals, err := loadSignals(ctx, candidates, viewer, now)
+
+    if err != nil {
+        return nil, err
+    }
+
+    ranked := rankPosts(candidates, signals, feedScorer)
+
+    start := req.Page * PostsPerRequest
+
+    if req.Page < 0 || start >= len(ranked) {
+        return []Post{}, nil
+    }
+
+    end := start + PostsPerRequest
+
+    if end > len(ranked) {
+        end = len(ranked)
+    }
+
+    return ranked[start:end], nil
+}
+
+func loadSignals(ctx context.Context, posts []Post, viewer string, now time.Time) (map[int]PostSignals, error) {
+    ctx, cancel := context.WithTimeout(ctx, feedTimeout)
+    defer cancel()
+
+    signals := make(map[int]PostSignals, len(posts))
+
+    if len(posts) == 0 {
+        return signals, nil
+    }
+
+    query := `SELECT p.id,
+                (SELECT COUNT(*) FROM comment c WHERE c.postid = p.id AND c.deleted IS NULL),
+                (SELECT COUNT(*) FROM reaction r WHERE r.post AND r.postid = p.id),
+                (SELECT COUNT(*) FROM post s WHERE s.sharedid = p.id AND s.deleted IS NULL),
+                EXISTS (SELECT * FROM poll o WHERE o.postid = p.id),
+                p.sharedid IS NOT NULL,
+                p.content ~ 'https?://',
+                p.groupurl IS NOT NULL
+            FROM post p
+            WHERE p.id = ANY($1);`
+
+    rows, err := db.QueryContext(ctx, query, pq.Array(postIds(posts)))
+
+    if err != nil {
+        return nil, err
+    }
+
+    defer rows.Close()
+
+    for rows.Next() {
+        var id int
+        var s PostSignals
+        err = rows.Scan(&id, &s.Comments, &s.Reactions, &s.Shares, &s.Poll, &s.Share, &s.Link, &s.Group)
+
+        if err != nil {
+            return nil, err
+        }
+
+        signals[id] = s
+    }
+
+    if err = rows.Err(); err != nil {
+        return nil, err
+    }
+
+    affinity, err := loadAffinity(ctx, posts, viewer)
+
+    if err != nil {
+        return nil, err
+    }
+
+    for _, post := range posts {
+        s := signals[post.ID]
+        s.Age = now.Sub(post.Timestamp)
+        s.Affinity = affinity[post.AuthorUrl]
+        signals[post.ID] = s
+    }
+
+    return signals, nil
+}
+
+// How often viewer has commented or reacted on each author's posts.
+func loadAffinity(ctx context.Context, posts []Post, viewer string) (map[string]int, error) {
+    authors := make([]string, 0, len(posts))
+
+    for _, post := range posts {
+        authors = append(authors, post.AuthorUrl)
+    }
+
+    query := `SELECT i.authorurl, COUNT(*)
+            FROM (SELECT p.authorurl
+                FROM comment c, post p
+                WHERE c.authorurl = $1
+                AND p.id = c.postid
+                AND p.authorurl = ANY($2)
+                UNION ALL
+                SELECT p.authorurl
+                FROM reaction r, post p
+                WHERE r.authorurl = $1
+                AND r.post
+                AND p.id = r.postid
+                AND p.authorurl = ANY($2)) i
+            GROUP BY i.authorurl;`
+
+    rows, err := db.QueryContext(ctx, query, viewer, pq.Array(authors))
+
+    if err != nil {
+        return nil, err
+    }
+
+    defer rows.Close()
+
+    affinity := make(map[string]int)
+
+    for rows.Next() {
+        var author string
+        var count int
+        err = rows.Scan(&author, &count)
+
+        if err != nil {
+            return nil, err
+        }
+
+        affinity[author] = count
+    }
+
+    return affinity, rows.Err()
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+    "math"
+    "testing"
+    "time"
+)
+
+var testScorer = WeightedScorer{
+    HalfLife: time.Hour,
+    Affinity: 1,
+    Engagement: 1,
+    Poll: 0.5,
+    Share: -0.25,
+    Link: 0.25,
+    Group: 0.125,
+}
+
+func TestWeightedScorerScore(t *testing.T) {
+    tests := []struct {
+        name    string
+        scorer  WeightedScorer
+        signals PostSignals
+        want    float64
+    }{
+        {"new and plain", testScorer, PostSignals{}, 1},
+        {"one half-life old", testScorer, PostSignals{Age: time.Hour}, 0.5},
+        {"two half-lives old", testScorer, PostSignals{Age: 2 * time.Hour}, 0.25},
+        {"half a half-life old", testScorer, PostSignals{Age: 30 * time.Minute}, math.Sqrt2 / 2},
+        {"affinity", testScorer, PostSignals{Affinity: 1}, 1 + math.Ln2},
+        {"comments count double", testScorer, PostSignals{Comments: 1}, 1 + math.Log(3)},
+        {"reactions count once", testScorer, PostSignals{Reactions: 2}, 1 + math.Log(3)},
+        {"shares count treble", testScorer, PostSignals{Shares: 1}, 1 + math.Log(4)},
+        {"all engagement", testScorer, PostSignals{Comments: 1, Reactions: 1, Shares: 1},
+                1 + math.Log(7)},
+        {"poll", testScorer, PostSignals{Poll: true}, 1.5},
+        {"share", testScorer, PostSignals{Share: true}, 0.75},
+        {"link", testScorer, PostSignals{Link: true}, 1.25},
+        {"group", testScorer, PostSignals{Group: true}, 1.125},
+        {"types add up", testScorer, PostSignals{Poll: true, Link: true, Group: true}, 1.875},
+        {"decay applies to boosts", testScorer, PostSignals{Age: time.Hour, Poll: true, Link: true},
+                0.875},
+        {"boost never goes negative", WeightedScorer{HalfLife: time.Hour, Share: -2},
+                PostSignals{Share: true}, 0},
+    }
+
+    for _, test := range tests {
+        if got := test.scorer.Score(test.signals); math.Abs(got - test.want) > 1e-9 {
+            t.Errorf("%s: Score = %v, want %v", test.name, got, test.want)
+        }
+    }
+}
+
+// Scores every post the same, leaving the order to the tie-breaks.
+type flatScorer struct{}
+
+func (flatScorer) Score(s PostSignals) float64 {
+    return 1
+}
+
+func TestRankPosts(t *testing.T) {
+    now := time.Date(2024, time.March, 1, 12, 0, 0, 0, time.UTC)
+
+    post := func(id int, age time.Duration) Post {
+        return Post{ID: id, Timestamp: now.Add(-age)}
+    }
+
+    tests := []struct {
+        name    string
+        scorer  Scorer
+        posts   []Post
+        signals map[int]PostSignals
+        want    []int
+    }{
+        {
+            "newer first",
+            testScorer,
+            []Post{post(1, 3 * time.Hour), post(2, time.Hour), post(3, 2 * time.Hour)},
+            map[int]PostSignals{},
+            []int{2, 3, 1},
+        },
+        {
+            "affinity outweighs a little age",
+            testScorer,
+            []Post{post(1, 0), post(2, 30 * time.Minute)},
+            map[int]PostSignals{2: {Affinity: 3}},
+            []int{2, 1},
+        },
+        {
+            "engagement outweighs a little age",
+            testScorer,
+            []Post{post(1, 0), post(2, 30 * time.Minute)},
+            map[int]PostSignals{2: {Comments: 2, Reactions: 5}},
+            []int{2, 1},
+        },
+        {
+            "but not a lot of age",
+            testScorer,
+            []Post{post(1, 0), post(2, 10 * time.Hour)},
+            map[int]PostSignals{2: {Comments: 2, Reactions: 5}},
+            []int{1, 2},
+        },
+        {
+            "content types",
+            testScorer,
+            []Post{post(1, 0), post(2, 0), post(3, 0), post(4, 0)},
+            map[int]PostSignals{1: {Share: true}, 2: {Link: true}, 3: {Poll: true}},
+            []int{3, 2, 4, 1},
+        },
+        {
+            "ties go to the newer post",
+            flatScorer{},
+            []Post{post(1, 2 * time.Hour), post(2, 3 * time.Hour), post(3, time.Hour)},
+            map[int]PostSignals{},
+            []int{3, 1, 2},
+        },
+        {
+            "then to the higher id",
+            flatScorer{},
+            []Post{post(4, time.Hour), post(9, time.Hour), post(2, 0), post(7, time.Hour)},
+            map[int]PostSignals{},
+            []int{2, 9, 7, 4},
+        },
+    }
+
+    for _, test := range tests {
+        // Ages as loadSignals measures them, from the fixed now
+        signals := make(map[int]PostSignals)
+
+        for _, p := range test.posts {
+            s := test.signals[p.ID]
+            s.Age = now.Sub(p.Timestamp)
+            signals[p.ID] = s
+        }
+
+        original := append([]Post(nil), test.posts...)
+        ranked := rankPosts(test.posts, signals, test.scorer)
+
+        if got := postIds(ranked); !equalIds(got, test.want) {
+            t.Errorf("%s: ranked %v, want %v", test.name, got, test.want)
+        }
+
+        if !equalIds(postIds(test.posts), postIds(original)) {
+            t.Errorf("%s: rankPosts reordered its input", test.name)
+        }
+    }
+}
+
+func equalIds(a []int, b []int) bool {
+    if len(a) != len(b) {
+        return false
+    }
+
+    for i := range a {
+        if a[i] != b[i] {
+            return false
+        }
+    }
+
+    return true
+}
@@ -1,8 +1,12 @@
 package main
 
 import(
+    "bytes"
+    "context"
+    "database/sql"
     "net/http"
-    _ "github.com/lib/pq"
+    "github.com/lib/pq"
+    "encoding/gob"
     "encoding/json"
     "log"
 )
@@ -41,11 +45,11 @@ func reactionHandler(w http.ResponseWriter, r *http.Request, url string) {
 
     switch path[1] {
     case "new":
-        err = newReaction(react.identifier, react.authorUrl, react.toPost, react.isLike)
+        err = newReaction(r.Context(), react.identifier, react.authorUrl, react.toPost, react.isLike)
     case "delete":
-        err = deleteReaction(react.identifier, react.authorUrl, react.toPost)
+        err = deleteReaction(r.Context(), react.identifier, react.authorUrl, react.toPost)
     case "modify":
-        err = modifyReaction(react.identifier, react.authorUrl, react.toPost, react.isLike)
+        err = modifyReaction(r.Context(), react.identifier, react.authorUrl, react.toPost, react.isLike)
     default:
         http.NotFound(w, r)
         return
@@ -60,8 +64,79 @@ func reactionHandler(w http.ResponseWriter, r *http.Request, url string) {
     w.WriteHeader(200)
 }
 
+type ReactionCount struct {
+    Likes       int
+    Dislikes    int
+}
+
+// Fills in like and dislike counts, from the cache where it has them.
+func addReactionCounts(ctx context.Context, posts []*Post) error {
+    counts := make(map[int]ReactionCount)
+    var missing []int
+
+    for _, post := range posts {
+        var count ReactionCount
+
+        if data, ok := cache.Get(reactionsKey(post.ID)); ok &&
+                gob.NewDecoder(bytes.NewReader(data)).Decode(&count) == nil {
+            counts[post.ID] = count
+        } else {
+            missing = append(missing, post.ID)
+        }
+    }
+
+    if len(missing) > 0 {
+        query := `SELECT p.id,
+                    COUNT(r.postid) FILTER (WHERE r."like"),
+                    COUNT(r.postid) FILTER (WHERE NOT r."like")
+                FROM post p
+                LEFT JOIN reaction r ON r.post AND r.postid = p.id
+                WHERE p.id = ANY($1)
+                GROUP BY p.id;`
+
+        rows, err := db.QueryContext(ctx, query, pq.Array(missing))
+
+        if err != nil {
+            return err
+        }
+
+        defer rows.Close()
+
+        for rows.Next() {
+            var id int
+            var count ReactionCount
+            err = rows.Scan(&id, &count.Likes, &count.Dislikes)
+
+            if err != nil {
+                return err
+            }
+
+            var buf bytes.Buffer
 
-func getReactions(identifier int, toPost bool) ([]Reaction, error) {
+            if gob.NewEncoder(&buf).Encode(count) == nil {
+                cache.Set(reactionsKey(id), buf.Bytes(), reactionTTL)
+            }
+
+            counts[id] = count
+        }
+
+        if err = rows.Err(); err != nil {
+            return err
+        }
+    }
+
+    for _, post := range posts {
+        post.Likes = counts[post.ID].Likes
+        post.Dislikes = counts[post.ID].Dislikes
+    }
+
+    return nil
+}
+
+
+func getReactions(ctx context.Context, identifier int, toPost bool) ([]Reaction, error) {
+    ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+    defer cancel()
 
     var query string
 
@@ -77,7 +152,7 @@ func getReactions(identifier int, toPost bool) ([]Reaction, error) {
                 AND commentid = $1;`
     }
 
-    rows, err := db.Query(query, identifier)
+    rows, err := db.QueryContext(ctx, query, identifier)
 
     if err != nil {
         return nil, err
@@ -98,7 +173,10 @@ func getReactions(identifier int, toPost bool) ([]Reaction, error) {
     return reactions, nil
 }
 
-func newReaction(identifier int, userUrl string, toPost bool, isLike bool) error {
+func newReaction(ctx context.Context, identifier int, userUrl string, toPost bool, isLike bool) error {
+    ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+    defer cancel()
+
     
     var query string
     
@@ -110,12 +188,19 @@ func newReaction(identifier int, userUrl string, toPost bool, isLike bool) error
             VALUES ($1, $2, false, 0, $3);`
     }
 
-    _, err := db.Exec(query, userUrl, isLike, identifier)
+    _, err := db.ExecContext(ctx, query, userUrl, isLike, identifier)
+
+    if err == nil && toPost {
+        invalidateReactions(identifier)
+    }
 
     return err
 }
 
-func deleteReaction(identifier int, userUrl string, toPost bool) error {
+func deleteReaction(ctx context.Context, identifier int, userUrl string, toPost bool) error {
+    ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+    defer cancel()
+
     var query string
     
     if toPost {
@@ -130,12 +215,18 @@ func deleteReaction(identifier int, userUrl string, toPost bool) error {
                 AND commentid = $2;`
     }
 
-    _, err := db.Exec(query, userUrl, identifier)
+    _, err := db.ExecContext(ctx, query, userUrl, identifier)
+
+    if err == nil && toPost {
+        invalidateReactions(identifier)
+    }
 
     return err
 }
 
-func modifyReaction(identifier int, userUrl string, toPost bool, isLike bool) error {
+func modifyReaction(ctx context.Context, identifier int, userUrl string, toPost bool, isLike bool) error {
+    ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+    defer cancel()
 
     var query string
 
@@ -151,7 +242,52 @@ func modifyReaction(identifier int, userUrl string, toPost bool, isLike bool) er
                 AND commentid = $3;`
     }
 
-    _, err := db.Exec(query, isLike, userUrl, identifier)
+    _, err := db.ExecContext(ctx, query, isLike, userUrl, identifier)
+
+    if err == nil && toPost {
+        invalidateReactions(identifier)
+    }
 
     return err
 }
+
+// Evicts the cached like and dislike counts of posts.
+func invalidateReactions(postIds ...int) {
+    keys := make([]string, len(postIds))
+
+    for i, id := range postIds {
+        keys[i] = reactionsKey(id)
+    }
+
+    cache.Delete(keys...)
+}
+
+// Runs query, a DELETE from reaction returning post and postid, and returns
+// the posts whose counts it changed.
+func deleteReactions(ctx context.Context, tx *sql.Tx, query string, args ...interface{}) ([]int, error) {
+    rows, err := tx.QueryContext(ctx, query, args...)
+
+    if err != nil {
+        return nil, err
+    }
+
+    defer rows.Close()
+
+    var postIds []int
+
+    for rows.Next() {
+        var post bool
+        var postId int
+        err = rows.Scan(&post, &postId)
+
+        if err != nil {
+            return nil, err
+        }
+
+        if post {
+            postIds = append(postIds, postId)
+        }
+    }
+
+    return postIds, rows.Err()
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+    "context"
+    "net/http"
+    "github.com/gorilla/mux"
+    "database/sql"
+    _ "github.com/lib/pq"
+    "encoding/json"
+    "errors"
+    "log"
+    "time"
+)
+
+// Posts and comments can only be edited this long after they were written.
+const EditWindow = 24 * time.Hour
+
+// Whether anyone who can see a post or comment may see its earlier
+// versions, rather than only its author.
+const ViewersSeeEditHistory = true
+
+var errEditWindow = errors.New("Too late to edit")
+
+// A previous version of a post or comment, timestamped with when it was
+// written.
+type Revision struct {
+    Content     string      `json:"content"`
+    Timestamp   time.Time   `json:"timestamp"`
+}
+
+// Lists the earlier versions of a post or comment, newest first.
+func revisionHandler(w http.ResponseWriter, r *http.Request) {
+    vars := mux.Vars(r)
+    kind := vars["kind"]
+    id := vars["id"]
+
+    if kind != "post" && kind != "comment" {
+        http.NotFound(w, r)
+        return
+    }
+
+    email, ok := checkAuthorisation(w, r)
+
+    if !ok {
+        return
+    }
+
+    user, err := profileUrlForEmail(r.Context(), email)
+
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusForbidden)
+        return
+    }
+
+    revisions, err := loadRevisions(r.Context(), kind, id, user)
+
+    if err == sql.ErrNoRows {
+        http.NotFound(w, r)
+        return
+    }
+
+    if err == errNotPermitted {
+        http.Error(w, err.Error(), http.StatusForbidden)
+        return
+    }
+
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    err = json.NewEncoder(w).Encode(revisions)
+
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        log.Println(err)
+    }
+}
+
+// Records the current content of a post or comment, where table is "post"
+// or "comment", before author replaces it. changed is false when the new
+// content is the same and there is nothing to record. Only the author may
+// edit; errNotPermitted for anyone else.
+func saveRevision(ctx context.Context, tx *sql.Tx, table string, id string, author string, content string) (changed bool, err error) {
+    query := `SELECT content, timestamp < now() - $2 * interval '1 second', authorurl = $3
+            FROM ` + table + `
+            WHERE id = $1
+            AND deleted IS NULL
+            FOR UPDATE;`
+
+    var current string
+    var expired, isAuthor bool
+    err = tx.QueryRowContext(ctx, query, id, EditWindow.Seconds(), author).Scan(&current,
+            &expired, &isAuthor)
+
+    if err != nil {
+        return false, err
+    }
+
+    if !isAuthor {
+        return false, errNotPermitted
+    }
+
+    if expired {
+        return false, errEditWindow
+    }
+
+    if current == content {
+        return false, nil
+    }
+
+    query = `INSERT INTO revision (` + table + `id, content, timestamp)
+            SELECT id, content, COALESCE(edited, timestamp)
+            FROM ` + table + `
+            WHERE id = $1;`
+
+    _, err = tx.ExecContext(ctx, query, id)
+
+    return err == nil, err
+}
+
+func loadRevisions(ctx context.Context, kind string, id string, user string) ([]Revision, error) {
+    ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+    defer cancel()
+
+    var query string
+
+    if kind == "post" {
+        query = `SELECT authorurl, id
+                FROM post
+                WHERE id = $1
+                AND deleted IS NULL;`
+    } else {
+        query = `SELECT authorurl, postid
+                FROM comment
+                WHERE id = $1
+                AND deleted IS NULL;`
+    }
+
+    var author string
+    var postId int
+    err := db.QueryRowContext(ctx, query, id).Scan(&author, &postId)
+
+    if err != nil {
+        return nil, err
+    }
+
+    if author != user {
+        if !ViewersSeeEditHistory {
+            return nil, errNotPermitted
+        }
+
+        visible, err := postVisible(ctx, postId, user)
+
+        if err != nil {
+            return nil, err
+        }
+
+        if !visible {
+            return nil, sql.ErrNoRows
+        }
+    }
+
+    query = `SELECT content, timestamp
+            FROM revision
+            WHERE ` + kind + `id = $1
+            ORDER BY timestamp DESC;`
+
+    rows, err := db.QueryContext(ctx, query, id)
+
+    if err != nil {
+        return nil, err
+    }
+
+    defer rows.Close()
+
+    revisions := []Revision{}
+
+    for rows.Next() {
+        var rev Revision
+        err = rows.Scan(&rev.Content, &rev.Timestamp)
+
+        if err != nil {
+            return nil, err
+        }
+
+        revisions = append(revisions, rev)
+    }
+
+    return revisions, rows.Err()
+}
@@ -1,12 +1,14 @@
 package main
 
 import(
+    "context"
+    "time"
     "net/http"
     "github.com/gorilla/mux"
     "database/sql"
-    "bytes"
     _ "github.com/lib/pq"
     "encoding/json"
+    "html"
     "log"
     "strings"
 )
@@ -14,16 +16,46 @@ import(
 const NumLiveResults int = 5
 const NumResults int = 50
 
+const (
+    ScopePeople = "people"
+    ScopeContent = "content"
+)
+
 type Search struct {
     UserEmail   string  `json:"userEmail"`
     Live        bool    `json:"live"`
     Submit      bool    `json:"submit"`
+    Scope       string  `json:"scope"`
+    Page        int     `json:"page"`
 }
 
 type Result struct {
     URL         string  `json:"url"`
     FirstName   string  `json:"firstname"`
     LastName    string  `json:"lastname"`
+    Score       float64 `json:"score"`
+}
+
+// Marks ts_headline puts around matches, from the private use area so they
+// can't be confused with anything users write. They are turned into <mark>
+// tags once the snippet has been escaped.
+const (
+    markStart = "\uE000"
+    markStop = "\uE001"
+)
+
+const headlineOptions = "StartSel=" + markStart + ", StopSel=" + markStop + ", MaxFragments=2"
+
+// A post or comment matching a content search. Snippet holds the matching
+// fragments, HTML-escaped, with terms wrapped in <mark> tags.
+type ContentResult struct {
+    Kind        string      `json:"kind"`
+    ID          int         `json:"id"`
+    PostId      int         `json:"postId"`
+    AuthorUrl   string      `json:"authorUrl"`
+    Timestamp   time.Time   `json:"timestamp"`
+    Snippet     string      `json:"snippet"`
+    Rank        float64     `json:"rank"`
 }
 
 func searchHandler(w http.ResponseWriter, r *http.Request) {
@@ -43,8 +75,22 @@ func searchHandler(w http.ResponseWriter, r *http.Request) {
         return
     }
 
+    // The searcher is whoever the credentials say, never the body. Saving
+    // and content search need them; people search just hides blocks with
+    // them.
+    s.UserEmail = ""
+
+    if _, _, present := r.BasicAuth(); present || s.Submit || s.Scope == ScopeContent {
+        var ok bool
+        s.UserEmail, ok = checkAuthorisation(w, r)
+
+        if !ok {
+            return
+        }
+    }
+
     if s.Submit {
-        err = submitSearch(s.UserEmail, query)
+        err = submitSearch(r.Context(), s.UserEmail, query)
 
         if err != nil {
             if err == sql.ErrNoRows {
@@ -54,9 +100,32 @@ func searchHandler(w http.ResponseWriter, r *http.Request) {
                 log.Println(err)
             }
         }
+    } else if s.Scope == ScopeContent {
+        var viewer string
+        viewer, err = profileUrlForEmail(r.Context(), s.UserEmail)
+
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusForbidden)
+            return
+        }
+
+        var results []ContentResult
+        results, err = searchContent(r.Context(), viewer, s, query)
+
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+            return
+        }
+
+        err = json.NewEncoder(w).Encode(results)
+
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+            log.Println(err)
+        }
     } else {
         var results []Result
-        results, err = search(s, query)
+        results, err = search(r.Context(), s, query)
 
         if err != nil {
             http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -93,7 +162,7 @@ func recentSearchHandler(w http.ResponseWriter, r *http.Request, query string) {
     }
 
     var results []Result
-    results, err = getAllRecent(email)
+    results, err = getAllRecent(r.Context(), email)
 
     if err != nil {
         http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -127,7 +196,7 @@ func saveSearchHandler(w http.ResponseWriter, r *http.Request, query string) {
         return
     }
 
-    err = submitSearch(email, query)
+    err = submitSearch(r.Context(), email, query)
 
     if err != nil {
         http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -137,88 +206,117 @@ func saveSearchHandler(w http.ResponseWriter, r *http.Request, query string) {
     w.WriteHeader(http.StatusOK)
 }
 
-func search(s Search, searchString string) ([]Result, error) {
+func search(ctx context.Context, s Search, searchString string) ([]Result, error) {
 
     if searchString == "" {
-        return getAllRecent(s.UserEmail)
+        return getAllRecent(ctx, s.UserEmail)
     }
 
-    var (
-        results []Result
-        numResults int
-        exp bytes.Buffer
-        sep = ""
-    )
+    ctx, cancel := context.WithTimeout(ctx, searchTimeout)
+    defer cancel()
+
+    numResults := NumResults
 
     if s.Live {
         numResults = NumLiveResults
-    } else {
-        numResults = NumResults
     }
 
-    exp.WriteString("%(")
-    for _, word := range strings.Split(searchString, "+") {
-        exp.WriteString(sep)
-        exp.WriteString(strings.ToLower(word))
-        sep = "|"
-    }
-    exp.WriteString(")%")
+    term := strings.ToLower(strings.TrimSpace(strings.Replace(searchString, "+", " ", -1)))
+
+    if term == "" {
+        return getAllRecent(ctx, s.UserEmail)
+    }
+
+    // Candidates are profiles whose full name is trigram-similar to the term,
+    // start with it, or whose email or url match it exactly. The score adds
+    // to the similarity:
+    //   1.0   exact email or url match
+    //   0.5   name starts with the term
+    //   0.4   accepted connection, or 0.15 for a friend of a friend
+    //   0.3   previously chosen from search, decaying over weeks
+    query := `WITH viewer AS (SELECT url FROM profile WHERE email = $1),
+            hidden AS (SELECT b.blocked AS url
+                        FROM block b, viewer v
+                        WHERE b.blocker = v.url
+                        UNION
+                        SELECT b.blocker
+                        FROM block b, viewer v
+                        WHERE b.blocked = v.url),
+            friends AS (SELECT CASE WHEN c.fromurl = v.url THEN c.tourl ELSE c.fromurl END AS url
+                        FROM connection c, viewer v
+                        WHERE c.accepted
+                        AND v.url IN(c.fromurl, c.tourl)),
+            fof AS (SELECT CASE WHEN c.fromurl = f.url THEN c.tourl ELSE c.fromurl END AS url
+                        FROM connection c, friends f
+                        WHERE c.accepted
+                        AND f.url IN(c.fromurl, c.tourl)),
+            recent AS (SELECT resultUrl AS url, MAX(timestamp) AS searched
+                        FROM search
+                        WHERE acctEmail = $1
+                        GROUP BY resultUrl),
+            candidates AS (SELECT p.url, p.firstname, p.lastname,
+                            similarity(lower(p.firstname || ' ' || p.lastname), $2) AS sim,
+                            (lower(p.firstname || ' ' || p.lastname) LIKE $3 ESCAPE '\'
+                                OR lower(p.lastname) LIKE $3 ESCAPE '\') AS prefix,
+                            (lower(p.email) = $2 OR lower(p.url) = $2) AS exact
+                        FROM profile p
+                        WHERE (lower(p.firstname || ' ' || p.lastname) % $2
+                            OR lower(p.firstname || ' ' || p.lastname) LIKE $3 ESCAPE '\'
+                            OR lower(p.lastname) LIKE $3 ESCAPE '\'
+                            OR lower(p.email) = $2
+                            OR lower(p.url) = $2)
+                        AND p.url NOT IN (SELECT url FROM viewer)
+                        AND p.url NOT IN (SELECT url FROM hidden)
+                        AND NOT EXISTS (SELECT *
+                                        FROM account a
+                                        WHERE a.email = p.email
+                                        AND a.deactivated IS NOT NULL))
+            SELECT c.url, c.firstname, c.lastname,
+                c.sim
+                + CASE WHEN c.exact THEN 1.0 ELSE 0 END
+                + CASE WHEN c.prefix THEN 0.5 ELSE 0 END
+                + CASE WHEN c.url IN (SELECT url FROM friends) THEN 0.4
+                    WHEN c.url IN (SELECT url FROM fof) THEN 0.15
+                    ELSE 0 END
+                + COALESCE((SELECT 0.3 / (1 + EXTRACT(EPOCH FROM now() - r.searched) / 604800)
+                            FROM recent r
+                            WHERE r.url = c.url), 0) AS score
+            FROM candidates c
+            ORDER BY score DESC, c.lastname, c.firstname, c.url
+            LIMIT $4;`
 
-    r, err := searchRecent(s.UserEmail, exp.String(), numResults)
+    rows, err := db.QueryContext(ctx, query, s.UserEmail, term, escapeLike(term) + "%", numResults)
 
     if err != nil {
         return nil, err
     }
 
-    for _,res := range r {
-        results = append(results, res)
-    }
+    defer rows.Close()
 
-    if len(r) < numResults {
-        r, err = searchFriends(s.UserEmail, exp.String(), numResults - len(r))
-
-        if (err != nil) {
-            return nil, err
-        }
-
-        for _,res := range r {
-            if !contains(results, res) {
-                results = append(results, res)
-            }
-        }
-    }
+    var results []Result
 
-    if len(r) < numResults {
-        r, err = searchAll(s.UserEmail, exp.String(), numResults - len(r))
+    for rows.Next() {
+        var res Result
+        err = rows.Scan(&res.URL, &res.FirstName, &res.LastName, &res.Score)
 
         if err != nil {
             return nil, err
         }
 
-        for _,res := range r {
-            if !contains(results, res) {
-                results = append(results, res)
-            }
-        }
+        results = append(results, res)
     }
 
-
-
-    return results, nil
+    return results, rows.Err()
 }
 
-func contains(list []Result, res Result) bool {
-
-    for _, item := range list {
-        if item.URL == res.URL {
-            return true
-        }
-    }
-
-    return false
+// Escapes LIKE wildcards so user input only ever matches literally.
+func escapeLike(s string) string {
+    return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
 }
 
-func getAllRecent(userEmail string) ([]Result, error) {
+func getAllRecent(ctx context.Context, userEmail string) ([]Result, error) {
+    ctx, cancel := context.WithTimeout(ctx, searchTimeout)
+    defer cancel()
 
     query := `SELECT profile.url, profile.firstname, profile.lastname
         FROM profile, search
@@ -227,7 +325,7 @@ func getAllRecent(userEmail string) ([]Result, error) {
         ORDER BY search.timestamp DESC
         LIMIT $2;`
 
-    rows, err := db.Query(query, userEmail, NumLiveResults)
+    rows, err := db.QueryContext(ctx, query, userEmail, NumLiveResults)
 
     if err != nil {
         return nil, err
@@ -248,111 +346,96 @@ func getAllRecent(userEmail string) ([]Result, error) {
     return results, nil
 }
 
-func searchRecent(userEmail string, searchExp string, numResults int) ([]Result, error) {
-
-    query := `SELECT profile.url, profile.firstname, profile.lastname
-            FROM profile, search
-            WHERE search.acctEmail = $1 
-            AND profile.url = search.resultUrl
-            AND (lower(profile.firstname) SIMILAR TO $2 
-                OR lower(profile.lastname) SIMILAR TO $2
-                OR lower(profile.email) = $3
-                OR lower(profile.url) = $3)
-            ORDER BY search.timestamp DESC
-            LIMIT $4;`
+func submitSearch(ctx context.Context, userEmail string, result string) error {
+    ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+    defer cancel()
 
-    rows, err := db.Query(query, userEmail, searchExp, searchExp[2:len(searchExp)-2], numResults)
-
-    if err != nil {
-        return nil, err
-    }
+    query := `INSERT INTO search (acctEmail, resultUrl)
+            VALUES ($1, $2);`
 
-    var results []Result
+    _, err := db.ExecContext(ctx, query, userEmail, result)
 
-    for rows.Next() {
-        var res Result
-        err = rows.Scan(&(res.URL), &(res.FirstName), &(res.LastName))
-        results = append(results, res)
-    }
-
-    if err != nil {
-        return nil, err
-    }
-
-    return results, nil
+    return err
 }
 
-func searchFriends(userEmail string, searchExp string, numResults int) ([]Result, error) {
-
-    query := `SELECT DISTINCT res.url, res.firstname, res.lastname
-            FROM profile res, profile usr, connection
-            WHERE usr.email = $1
-            AND (lower(res.firstname) SIMILAR TO $2 
-                OR lower(res.lastname) SIMILAR TO $2
-                OR lower(res.email) = $3
-                OR lower(res.url) = $3)
-            AND (res.url IN(connection.fromurl, connection.tourl) 
-            AND usr.url IN(connection.fromurl, connection.tourl))
-            AND NOT usr.url = res.url
-            LIMIT $4;`
-
-    rows, err := db.Query(query, userEmail, searchExp,searchExp[2:len(searchExp)-2], numResults)
-
-    if err != nil {
-        return nil, err
-    }
+// Full-text search over posts and comments viewer can see, by the same rule
+// as reading them. Comments by profiles blocked in either direction are left
+// out too.
+func searchContent(ctx context.Context, viewer string, s Search, searchString string) ([]ContentResult, error) {
+    ctx, cancel := context.WithTimeout(ctx, searchTimeout)
+    defer cancel()
 
-    var results []Result
-
-    for rows.Next() {
-        var res Result
-        err = rows.Scan(&(res.URL), &(res.FirstName), &(res.LastName))
-        results = append(results, res)
-    }
+    if searchString == "" {
+        return nil, nil
+    }
+
+    page := s.Page
+
+    if page < 0 {
+        page = 0
+    }
+
+    query := `WITH q AS (SELECT websearch_to_tsquery('english', $1) AS query),
+            hidden AS (SELECT b.blocked AS url
+                        FROM block b
+                        WHERE b.blocker = $2
+                        UNION
+                        SELECT b.blocker
+                        FROM block b
+                        WHERE b.blocked = $2),
+            visible AS (SELECT p.*
+                        FROM post p
+                        WHERE ` + postVisibleCondition + `)
+            SELECT 'post', p.id, p.id, p.authorurl, p.timestamp,
+                ts_headline('english', translate(p.content, $6, ''), q.query, $5),
+                ts_rank(p.tsv, q.query) AS rank
+            FROM visible p, q
+            WHERE p.tsv @@ q.query
+            UNION ALL
+            SELECT 'comment', c.id, c.postid, c.authorurl, c.timestamp,
+                ts_headline('english', translate(c.content, $6, ''), q.query, $5),
+                ts_rank(c.tsv, q.query) AS rank
+            FROM comment c, visible p, q
+            WHERE c.postid = p.id
+            AND c.deleted IS NULL
+            AND c.tsv @@ q.query
+            AND c.authorurl NOT IN (SELECT url FROM hidden)
+            ORDER BY rank DESC, 5 DESC
+            LIMIT $3 OFFSET $4;`
+
+    terms := strings.Replace(searchString, "+", " ", -1)
+    rows, err := db.QueryContext(ctx, query, terms, viewer, NumResults, page * NumResults,
+            headlineOptions, markStart + markStop)
 
     if err != nil {
         return nil, err
     }
 
-    return results, nil
-}
-
-func searchAll(userEmail string, searchExp string, numResults int) ([]Result, error) {
+    defer rows.Close()
 
-    query := `SELECT profile.url, profile.firstname, profile.lastname
-            FROM profile
-            WHERE (lower(profile.firstname) SIMILAR TO $1 
-                OR lower(profile.lastname) SIMILAR TO $1
-                OR lower(profile.email) = $2
-                OR lower(profile.url) = $2)
-            LIMIT $3;`
+    var results []ContentResult
 
-    rows, err := db.Query(query, searchExp, searchExp[2:len(searchExp)-2], numResults)
+    for rows.Next() {
+        var res ContentResult
+        err = rows.Scan(&res.Kind, &res.ID, &res.PostId, &res.AuthorUrl,
+                &res.Timestamp, &res.Snippet, &res.Rank)
 
-    if err != nil {
-        return nil, err
-    }
+        if err != nil {
+            return nil, err
+        }
 
-    var results []Result
+        res.Snippet = highlight(res.Snippet)
 
-    for rows.Next() {
-        var res Result
-        err = rows.Scan(&(res.URL), &(res.FirstName), &(res.LastName))
         results = append(results, res)
     }
 
-    if err != nil {
-        return nil, err
-    }
-
-    return results, nil
+    return results, rows.Err()
 }
 
-func submitSearch(userEmail string, result string) error {
-    query := `INSERT INTO search (acctEmail, resultUrl)
-            VALUES ($1, $2);`
-
-    _, err := db.Exec(query, userEmail, result)
+// Escapes a ts_headline snippet for HTML and marks its matches.
+func highlight(snippet string) string {
+    snippet = html.EscapeString(snippet)
+    snippet = strings.Replace(snippet, markStart, "<mark>", -1)
 
-    return err
+    return strings.Replace(snippet, markStop, "</mark>", -1)
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+    "context"
     "io/ioutil"
     "net/http"
     "database/sql"
@@ -8,6 +9,11 @@ import (
     "regexp"
     "github.com/gorilla/mux"
     "log"
+    "os"
+    "os/signal"
+    "sync/atomic"
+    "syscall"
+    "time"
 )
 
 var validPath = regexp.MustCompile("^/(profile|check|connect|account|register|post|comment|search|authenticate|feed)(/[a-zA-Z0-9])*$")
@@ -66,7 +72,7 @@ func checkAuthorisation(w http.ResponseWriter, r *http.Request) (string, bool) {
         return "", false
     }
 
-    err := authenticate(email, password)
+    err := authenticate(r.Context(), email, password)
 
     if err != nil {
         http.Error(w, err.Error(), http.StatusForbidden)
@@ -76,6 +82,60 @@ func checkAuthorisation(w http.ResponseWriter, r *http.Request) (string, bool) {
     return email, true
 }
 
+// For handlers acting as the profile at url: authenticates the request and
+// checks the account owns that profile, answering 403 if it doesn't.
+func checkProfileOwner(w http.ResponseWriter, r *http.Request, url string) bool {
+    email, ok := checkAuthorisation(w, r)
+
+    if !ok {
+        return false
+    }
+
+    query := `SELECT EXISTS (SELECT *
+                FROM profile
+                WHERE url = $1
+                AND email = $2);`
+
+    var owner bool
+    err := db.QueryRowContext(r.Context(), query, url, email).Scan(&owner)
+
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return false
+    }
+
+    if !owner {
+        http.Error(w, errNotPermitted.Error(), http.StatusForbidden)
+        return false
+    }
+
+    return true
+}
+
+// The profile making a request when it carries credentials, and "" for
+// anonymous requests. ok is false when credentials were given but rejected,
+// in which case the response has already been written.
+func optionalViewer(w http.ResponseWriter, r *http.Request) (viewer string, ok bool) {
+    if _, _, present := r.BasicAuth(); !present {
+        return "", true
+    }
+
+    email, ok := checkAuthorisation(w, r)
+
+    if !ok {
+        return "", false
+    }
+
+    viewer, err := profileUrlForEmail(r.Context(), email)
+
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusForbidden)
+        return "", false
+    }
+
+    return viewer, true
+}
+
 func main() {
     // Connect to database
     pwd, err := ioutil.ReadFile("auth")
@@ -84,7 +144,8 @@ func main() {
         log.Fatal(err)
     }
 
-    db, err = sql.Open("postgres", "user=postgres password=" + string(pwd) + " dbname=netwrk sslmode=require")
+    db, err = sql.Open("postgres", "user=postgres password=" + string(pwd) +
+            " dbname=netwrk sslmode=require statement_timeout=" + statementTimeout())
 
     if err != nil {
         log.Fatal(err)
@@ -92,6 +153,12 @@ func main() {
 
     defer db.Close()
 
+    err = migrate(context.Background())
+
+    if err != nil {
+        log.Fatal(err)
+    }
+
     // TLS Certificate Path
     cPath := "/etc/letsencrypt/live/netwrk.website/"
 
@@ -102,7 +169,8 @@ func main() {
     r.HandleFunc("/check/{url}", checkUrlHandler)
     r.HandleFunc("/connect/{action}/{p1}/{p2}", connectionHandler)
     r.HandleFunc("/post/{action}/{id}",postHandler)
-    r.HandleFunc("/comment{id}", makeHandler(commentHandler))
+    r.HandleFunc("/comment/{action}", commentHandler)
+    r.HandleFunc("/comment/{action}/{id}", commentHandler)
     r.HandleFunc("/search/recent", makeHandler(recentSearchHandler))
     r.HandleFunc("/search/save/{term}", makeHandler(saveSearchHandler))
     r.HandleFunc("/search/{term}", searchHandler)
@@ -110,10 +178,105 @@ func main() {
     r.HandleFunc("/register", makeHandler(registrationHandler))
     r.HandleFunc("/account/{action}", accountHandler)
     r.HandleFunc("/friends/{url}", friendListHandler)
+    r.HandleFunc("/requests/{box}/{url}", pendingRequestHandler)
+    r.HandleFunc("/follow/{action}/{p1}/{p2}", followHandler)
+    r.HandleFunc("/follows/{list}/{url}", followListHandler)
+    r.HandleFunc("/group/{action}/{url}", groupHandler)
+    r.HandleFunc("/group/{action}/{url}/{member}", groupHandler)
+    r.HandleFunc("/event/{action}", eventHandler)
+    r.HandleFunc("/event/{action}/{id}", eventHandler)
+    r.HandleFunc("/event/{action}/{id}/{member}", eventHandler)
+    r.HandleFunc("/suggest/{action}/{url}", suggestionHandler)
+    r.HandleFunc("/suggest/{action}/{url}/{other}", suggestionHandler)
     r.HandleFunc("/feed", feedHandler)
+    r.HandleFunc("/hashtag/{tag}", hashtagHandler)
+    r.HandleFunc("/trending", trendingHandler)
+    r.HandleFunc("/revisions/{kind}/{id}", revisionHandler)
+    r.HandleFunc("/trash/{action}", trashHandler)
+    r.HandleFunc("/trash/{action}/{kind}/{id}", trashHandler)
+    r.HandleFunc("/drafts/{action}", draftHandler)
+    r.HandleFunc("/drafts/{action}/{id}", draftHandler)
+    r.HandleFunc("/stories/{action}", storyHandler)
+    r.HandleFunc("/stories/{action}/{id}", storyHandler)
+    r.HandleFunc("/poll/{action}/{id}", pollHandler)
+    r.HandleFunc("/notifications/{action}", notificationHandler)
+    r.HandleFunc("/export/download/{token}", exportDownloadHandler)
+    r.HandleFunc("/export/{action}", exportHandler)
+    r.HandleFunc("/healthz", healthHandler)
+    r.HandleFunc("/readyz", readyHandler)
+
+    registerMetrics(r)
+    r.Use(etagMiddleware)
+
+    // Background jobs
+    jobs, stopJobs := context.WithCancel(context.Background())
+    defer stopJobs()
+
+    go runPeriodically(jobs, "Account purge", time.Hour, purgeDeactivatedAccounts)
+    go runPeriodically(jobs, "Export purge", time.Hour, purgeExpiredExports)
+    go runPeriodically(jobs, "Exports", 10 * time.Second, runExports)
+    go runPeriodically(jobs, "Preview purge", 24 * time.Hour, purgeStalePreviews)
+    go runPeriodically(jobs, "Trash purge", time.Hour, purgeTrash)
+    go runPeriodically(jobs, "Scheduled posts", time.Minute, publishScheduled)
+    go runPeriodically(jobs, "Story expiry", 10 * time.Minute, expireStories)
+    go runPeriodically(jobs, "Poll closing", time.Minute, closePolls)
+    go runPeriodically(jobs, "Timeline expiry", time.Hour, expireTimelines)
+
+    srv := &http.Server{
+        Addr: ":8000",
+        Handler: &NetwrkServer{r},
+        ReadHeaderTimeout: 5 * time.Second,
+        ReadTimeout: 15 * time.Second,
+        WriteTimeout: 30 * time.Second,
+        IdleTimeout: 120 * time.Second,
+    }
+
+    metrics := metricsServer()
+
+    go func() {
+        log.Println("Serving metrics on " + metrics.Addr)
+        err := metrics.ListenAndServe()
+
+        if err != http.ErrServerClosed {
+            log.Println("Metrics server: " + err.Error())
+        }
+    }()
 
-    http.Handle("/", &NetwrkServer{r})
+    go func() {
+        log.Println("Listening on port 8000...")
+        err := srv.ListenAndServeTLS(cPath + "fullchain.pem", cPath + "privkey.pem")
+
+        if err != http.ErrServerClosed {
+            log.Fatal(err)
+        }
+    }()
+
+    // Drain in-flight requests on SIGTERM before exiting
+    stop := make(chan os.Signal, 1)
+    signal.Notify(stop, syscall.SIGTERM, os.Interrupt)
+    <-stop
+
+    log.Println("Shutting down...")
+    atomic.StoreInt32(&draining, 1)
+    stopJobs()
+
+    // Keep serving while the load balancer notices /readyz failing
+    time.Sleep(drainPeriod())
+
+    ctx, cancel := context.WithTimeout(context.Background(), 30 * time.Second)
+    defer cancel()
+
+    err = srv.Shutdown(ctx)
+
+    if err != nil {
+        log.Println(err)
+    }
+
+    err = metrics.Shutdown(ctx)
+
+    if err != nil {
+        log.Println(err)
+    }
 
-    log.Println("Listening on port 8000...")
-    log.Fatal(http.ListenAndServeTLS(":8000", cPath + "fullchain.pem", cPath + "privkey.pem", nil))
+    log.Println("Server stopped")
 }
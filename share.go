@@ -0,0 +1,297 @@
+package main
+
+import (
+    "context"
+    "database/sql"
+    "github.com/lib/pq"
+    "time"
+)
+
+// Shares are posts on the sharer's own wall that point at the original by
+// id. The original is embedded when the post is read, and only if it still
+// exists and the viewer can see it; otherwise SharedUnavailable is set and
+// the share shows just its commentary.
+func createShare(ctx context.Context, id string, sharer string, content string) error {
+    ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+    defer cancel()
+
+    // Sharing a share shares the post it points at.
+    var original int
+    query := `SELECT COALESCE(sharedid, id)
+            FROM post
+            WHERE id = $1
+            AND deleted IS NULL;`
+
+    err := db.QueryRowContext(ctx, query, id).Scan(&original)
+
+    if err != nil {
+        return err
+    }
+
+    visible, err := postVisible(ctx, original, sharer)
+
+    if err != nil {
+        return err
+    }
+
+    if !visible {
+        return sql.ErrNoRows
+    }
+
+    query = `INSERT INTO post (profileurl, authorurl, content, sharedid)
+            VALUES ($1, $1, $2, $3)
+            RETURNING id;`
+
+    var shareId int
+    err = db.QueryRowContext(ctx, query, sharer, content, original).Scan(&shareId)
+
+    if err != nil {
+        return err
+    }
+
+    fanOut(ctx, shareId)
+
+    return nil
+}
+
+// Posts $2 may see, for queries with the post as p: their own, on a profile
+// they are connected to or by one they follow, or by a public profile on its
+// own wall. Group and event posts follow the group's and event's rules
+// instead, and blocks either way hide everything.
+const postVisibleCondition = `p.deleted IS NULL
+                AND NOT EXISTS (SELECT *
+                                FROM block b
+                                WHERE (b.blocker = $2 AND b.blocked IN(p.authorurl, p.profileurl))
+                                OR (b.blocked = $2 AND b.blocker IN(p.authorurl, p.profileurl)))
+                AND ($2 IN(p.authorurl, p.profileurl)
+                    OR (p.groupurl IS NOT NULL
+                        AND EXISTS (SELECT *
+                                    FROM groups g
+                                    WHERE g.url = p.groupurl
+                                    AND (g.privacy = 'public'
+                                        OR EXISTS (SELECT *
+                                                    FROM membership m
+                                                    WHERE m.groupurl = g.url
+                                                    AND m.profileurl = $2
+                                                    AND m.status = 'member'))))
+                    OR (p.eventid IS NOT NULL
+                        AND EXISTS (SELECT *
+                                    FROM event e
+                                    WHERE e.id = p.eventid
+                                    AND ` + eventVisibleCondition + `))
+                    OR (p.groupurl IS NULL
+                        AND p.eventid IS NULL
+                        AND (EXISTS (SELECT *
+                                    FROM profile a
+                                    WHERE a.url = p.authorurl
+                                    AND a.url = p.profileurl
+                                    AND NOT a.private)
+                            OR EXISTS (SELECT *
+                                        FROM connection c
+                                        WHERE c.accepted
+                                        AND $2 IN(c.fromurl, c.tourl)
+                                        AND (p.profileurl IN(c.fromurl, c.tourl)
+                                            OR p.authorurl IN(c.fromurl, c.tourl)))
+                            OR EXISTS (SELECT *
+                                        FROM follow f
+                                        WHERE f.follower = $2
+                                        AND f.approved
+                                        AND f.followed = p.authorurl))))`
+
+func postVisible(ctx context.Context, id int, viewer string) (bool, error) {
+    query := `SELECT EXISTS (SELECT *
+                FROM post p
+                WHERE p.id = $1
+                AND ` + postVisibleCondition + `);`
+
+    var visible bool
+    err := db.QueryRowContext(ctx, query, id, viewer).Scan(&visible)
+
+    return visible, err
+}
+
+// Fills in share counts, entities, link previews, polls and, for shares,
+// the embedded original as seen by viewer. An empty viewer only sees originals
+// that are public.
+func decoratePosts(ctx context.Context, posts []Post, viewer string) error {
+    if len(posts) == 0 {
+        return nil
+    }
+
+    ids := postIds(posts)
+
+    query := `SELECT p.id, COALESCE(p.sharedid, 0),
+                (SELECT COUNT(*)
+                FROM post s
+                WHERE s.sharedid = p.id
+                AND s.deleted IS NULL),
+                p.edited
+            FROM post p
+            WHERE p.id = ANY($1);`
+
+    rows, err := db.QueryContext(ctx, query, pq.Array(ids))
+
+    if err != nil {
+        return err
+    }
+
+    defer rows.Close()
+
+    shared := make(map[int]int)
+    shares := make(map[int]int)
+    edited := make(map[int]*time.Time)
+
+    for rows.Next() {
+        var id, sharedId, count int
+        var lastEdited *time.Time
+        err = rows.Scan(&id, &sharedId, &count, &lastEdited)
+
+        if err != nil {
+            return err
+        }
+
+        shared[id] = sharedId
+        shares[id] = count
+        edited[id] = lastEdited
+    }
+
+    if err = rows.Err(); err != nil {
+        return err
+    }
+
+    entities, err := loadEntities(ctx, "postid", ids)
+
+    if err != nil {
+        return err
+    }
+
+    var sharedIds []int
+
+    for _, sharedId := range shared {
+        if sharedId != 0 {
+            sharedIds = append(sharedIds, sharedId)
+        }
+    }
+
+    originals, err := loadShared(ctx, sharedIds, viewer)
+
+    if err != nil {
+        return err
+    }
+
+    for i := range posts {
+        post := &posts[i]
+        post.SharedId = shared[post.ID]
+        post.Shares = shares[post.ID]
+        post.Entities = entities[post.ID]
+        post.LastEdited = edited[post.ID]
+        post.Edited = post.LastEdited != nil
+
+        if post.SharedId == 0 {
+            continue
+        }
+
+        // Copied, so two shares of one original don't share a post
+        if original, ok := originals[post.SharedId]; ok {
+            copied := *original
+            post.Shared = &copied
+        }
+
+        post.SharedUnavailable = post.Shared == nil
+    }
+
+    withOriginals := make([]*Post, 0, len(posts))
+
+    for i := range posts {
+        withOriginals = append(withOriginals, &posts[i])
+
+        if posts[i].Shared != nil {
+            withOriginals = append(withOriginals, posts[i].Shared)
+        }
+    }
+
+    err = addPreviews(ctx, withOriginals)
+
+    if err != nil {
+        return err
+    }
+
+    err = addReactionCounts(ctx, withOriginals)
+
+    if err != nil {
+        return err
+    }
+
+    return addPolls(ctx, withOriginals, viewer)
+}
+
+// Loads the originals of shares by id. Originals that have been deleted or
+// that the viewer may not see are left out.
+func loadShared(ctx context.Context, ids []int, viewer string) (map[int]*Post, error) {
+    originals := make(map[int]*Post)
+
+    if len(ids) == 0 {
+        return originals, nil
+    }
+
+    query := `SELECT p.id, p.profileurl, p.authorurl, p.timestamp, p.content,
+                COALESCE(p.groupurl, ''), COALESCE(p.eventid, 0),
+                (SELECT COUNT(*)
+                FROM post s
+                WHERE s.sharedid = p.id
+                AND s.deleted IS NULL),
+                p.edited
+            FROM post p
+            WHERE p.id = ANY($1)
+            AND ` + postVisibleCondition + `;`
+
+    rows, err := db.QueryContext(ctx, query, pq.Array(ids), viewer)
+
+    if err != nil {
+        return nil, err
+    }
+
+    defer rows.Close()
+
+    var found []int
+
+    for rows.Next() {
+        var post Post
+        err = rows.Scan(&post.ID, &post.ProfileUrl, &post.AuthorUrl, &post.Timestamp,
+                &post.Content, &post.GroupUrl, &post.EventId, &post.Shares, &post.LastEdited)
+
+        if err != nil {
+            return nil, err
+        }
+
+        post.Edited = post.LastEdited != nil
+        originals[post.ID] = &post
+        found = append(found, post.ID)
+    }
+
+    if err = rows.Err(); err != nil {
+        return nil, err
+    }
+
+    entities, err := loadEntities(ctx, "postid", found)
+
+    if err != nil {
+        return nil, err
+    }
+
+    for id, post := range originals {
+        post.Entities = entities[id]
+    }
+
+    return originals, nil
+}
+
+func postIds(posts []Post) []int {
+    ids := make([]int, len(posts))
+
+    for i, post := range posts {
+        ids[i] = post.ID
+    }
+
+    return ids
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+    "context"
+    "net/http"
+    "github.com/gorilla/mux"
+    "database/sql"
+    _ "github.com/lib/pq"
+    "encoding/json"
+    "log"
+    "net/url"
+    "time"
+)
+
+// Stories are seen by the profile's accepted connections until they expire.
+const StoryLifetime = 24 * time.Hour
+
+// Stories are kept apart from posts: they never appear in feeds and are
+// removed outright once expired. Image is a link; stories hold no media
+// themselves. Views is only filled in for the story's owner.
+type Story struct {
+    ID          int         `json:"id"`
+    ProfileUrl  string      `json:"profileUrl"`
+    Content     string      `json:"content,omitempty"`
+    Image       string      `json:"image,omitempty"`
+    Created     time.Time   `json:"created"`
+    Expires     time.Time   `json:"expires"`
+    Seen        bool        `json:"seen"`
+    Views       int         `json:"views,omitempty"`
+}
+
+// A connection with active stories, for the tray shown above the feed.
+type StoryTray struct {
+    URL         string      `json:"url"`
+    FirstName   string      `json:"firstname"`
+    LastName    string      `json:"lastname"`
+    Stories     int         `json:"stories"`
+    Latest      time.Time   `json:"latest"`
+    Unseen      bool        `json:"unseen"`
+}
+
+type StoryViewer struct {
+    URL         string      `json:"url"`
+    FirstName   string      `json:"firstname"`
+    LastName    string      `json:"lastname"`
+    Viewed      time.Time   `json:"viewed"`
+}
+
+// new and tray act on the user; profile/{url} lists a profile's active
+// stories; view, viewers and delete take a story id.
+func storyHandler(w http.ResponseWriter, r *http.Request) {
+    vars := mux.Vars(r)
+    action := vars["action"]
+    id := vars["id"]
+
+    email, ok := checkAuthorisation(w, r)
+
+    if !ok {
+        return
+    }
+
+    user, err := profileUrlForEmail(r.Context(), email)
+
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusForbidden)
+        return
+    }
+
+    var result interface{}
+
+    switch action {
+    case "new":
+        var s Story
+        err = json.NewDecoder(r.Body).Decode(&s)
+
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusBadRequest)
+            return
+        }
+
+        if s.Content == "" && s.Image == "" {
+            http.Error(w, "Story is empty", http.StatusBadRequest)
+            return
+        }
+
+        if s.Image != "" {
+            image, err := url.Parse(s.Image)
+
+            if err != nil || (image.Scheme != "http" && image.Scheme != "https") || image.Host == "" {
+                http.Error(w, "Image must be an http or https link", http.StatusBadRequest)
+                return
+            }
+        }
+
+        result, err = createStory(r.Context(), user, s)
+    case "tray":
+        result, err = loadStoryTray(r.Context(), user)
+    case "profile":
+        result, err = loadStories(r.Context(), id, user)
+    case "view":
+        err = viewStory(r.Context(), id, user)
+    case "viewers":
+        result, err = loadStoryViewers(r.Context(), id, user)
+    case "delete":
+        err = deleteStory(r.Context(), id, user)
+    default:
+        http.NotFound(w, r)
+        return
+    }
+
+    if err != nil {
+        switch err {
+        case sql.ErrNoRows:
+            http.NotFound(w, r)
+        case errNotPermitted:
+            http.Error(w, err.Error(), http.StatusForbidden)
+        default:
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+        }
+
+        return
+    }
+
+    if result == nil {
+        w.WriteHeader(http.StatusOK)
+        return
+    }
+
+    err = json.NewEncoder(w).Encode(result)
+
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        log.Println(err)
+    }
+}
+
+func createStory(ctx context.Context, owner string, s Story) (*Story, error) {
+    ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+    defer cancel()
+
+    query := `INSERT INTO story (profileurl, content, image, expires)
+            VALUES ($1, $2, $3, now() + $4 * interval '1 second')
+            RETURNING id, created, expires;`
+
+    err := db.QueryRowContext(ctx, query, owner, s.Content, s.Image,
+            StoryLifetime.Seconds()).Scan(&s.ID, &s.Created, &s.Expires)
+
+    if err != nil {
+        return nil, err
+    }
+
+    s.ProfileUrl = owner
+
+    return &s, nil
+}
+
+// Whether viewer may see url's stories: their own, or an accepted
+// connection's.
+func canSeeStories(ctx context.Context, url string, viewer string) (bool, error) {
+    if url == viewer {
+        return true, nil
+    }
+
+    query := `SELECT EXISTS (SELECT *
+                FROM connection c
+                WHERE c.accepted
+                AND $1 IN(c.fromurl, c.tourl)
+                AND $2 IN(c.fromurl, c.tourl));`
+
+    var connected bool
+    err := db.QueryRowContext(ctx, query, url, viewer).Scan(&connected)
+
+    return connected, err
+}
+
+// Oldest first, the order they are played in.
+func loadStories(ctx context.Context, url string, viewer string) ([]Story, error) {
+    ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+    defer cancel()
+
+    visible, err := canSeeStories(ctx, url, viewer)
+
+    if err != nil {
+        return nil, err
+    }
+
+    if !visible {
+        return nil, sql.ErrNoRows
+    }
+
+    query := `SELECT s.id, s.content, s.image, s.created, s.expires,
+                EXISTS (SELECT *
+                        FROM storyview v
+                        WHERE v.storyid = s.id
+                        AND v.viewerurl = $2),
+                CASE WHEN s.profileurl = $2
+                    THEN (SELECT COUNT(*) FROM storyview v WHERE v.storyid = s.id)
+                    ELSE 0 END
+            FROM story s
+            WHERE s.profileurl = $1
+            AND s.expires > now()
+            ORDER BY s.created;`
+
+    rows, err := db.QueryContext(ctx, query, url, viewer)
+
+    if err != nil {
+        return nil, err
+    }
+
+    defer rows.Close()
+
+    stories := []Story{}
+
+    for rows.Next() {
+        s := Story{ProfileUrl: url}
+        err = rows.Scan(&s.ID, &s.Content, &s.Image, &s.Created, &s.Expires, &s.Seen, &s.Views)
+
+        if err != nil {
+            return nil, err
+        }
+
+        stories = append(stories, s)
+    }
+
+    return stories, rows.Err()
+}
+
+// Connections with active stories, most recently posted first.
+func loadStoryTray(ctx context.Context, user string) ([]StoryTray, error) {
+    ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+    defer cancel()
+
+    query := `SELECT p.url, p.firstname, p.lastname, COUNT(*), MAX(s.created),
+                bool_or(NOT EXISTS (SELECT *
+                                    FROM storyview v
+                                    WHERE v.storyid = s.id
+                                    AND v.viewerurl = $1))
+            FROM story s, profile p, connection c
+            WHERE s.expires > now()
+            AND p.url = s.profileurl
+            AND c.accepted
+            AND $1 IN(c.fromurl, c.tourl)
+            AND s.profileurl IN(c.fromurl, c.tourl)
+            AND s.profileurl <> $1
+            GROUP BY p.url, p.firstname, p.lastname
+            ORDER BY 5 DESC, p.url;`
+
+    rows, err := db.QueryContext(ctx, query, user)
+
+    if err != nil {
+        return nil, err
+    }
+
+    defer rows.Close()
+
+    tray := []StoryTray{}
+
+    for rows.Next() {
+        var t StoryTray
+        err = rows.Scan(&t.URL, &t.FirstName, &t.LastName, &t.Stories, &t.Latest, &t.Unseen)
+
+        if err != nil {
+            return nil, err
+        }
+
+        tray = append(tray, t)
+    }
+
+    return tray, rows.Err()
+}
+
+// Records that viewer has seen a story. Owners viewing their own stories
+// aren't counted.
+func viewStory(ctx context.Context, id string, viewer string) error {
+    ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+    defer cancel()
+
+    var owner string
+    query := `SELECT profileurl
+            FROM story
+            WHERE id = $1
+            AND expires > now();`
+
+    err := db.QueryRowContext(ctx, query, id).Scan(&owner)
+
+    if err != nil {
+        return err
+    }
+
+    if owner == viewer {
+        return nil
+    }
+
+    visible, err := canSeeStories(ctx, owner, viewer)
+
+    if err != nil {
+        return err
+    }
+
+    if !visible {
+        return sql.ErrNoRows
+    }
+
+    query = `INSERT INTO storyview (storyid, viewerurl)
+            VALUES ($1, $2)
+            ON CONFLICT DO NOTHING;`
+
+    _, err = db.ExecContext(ctx, query, id, viewer)
+
+    return err
+}
+
+// Only the story's owner may see who viewed it.
+func loadStoryViewers(ctx context.Context, id string, user string) ([]StoryViewer, error) {
+    ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+    defer cancel()
+
+    var owner string
+    query := `SELECT profileurl
+            FROM story
+            WHERE id = $1;`
+
+    err := db.QueryRowContext(ctx, query, id).Scan(&owner)
+
+    if err != nil {
+        return nil, err
+    }
+
+    if owner != user {
+        return nil, errNotPermitted
+    }
+
+    query = `SELECT p.url, p.firstname, p.lastname, v.timestamp
+            FROM storyview v, profile p
+            WHERE v.storyid = $1
+            AND p.url = v.viewerurl
+            ORDER BY v.timestamp DESC;`
+
+    rows, err := db.QueryContext(ctx, query, id)
+
+    if err != nil {
+        return nil, err
+    }
+
+    defer rows.Close()
+
+    viewers := []StoryViewer{}
+
+    for rows.Next() {
+        var v StoryViewer
+        err = rows.Scan(&v.URL, &v.FirstName, &v.LastName, &v.Viewed)
+
+        if err != nil {
+            return nil, err
+        }
+
+        viewers = append(viewers, v)
+    }
+
+    return viewers, rows.Err()
+}
+
+func deleteStory(ctx context.Context, id string, owner string) error {
+    ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+    defer cancel()
+
+    query := `DELETE FROM story
+            WHERE id = $1
+            AND profileurl = $2;`
+
+    res, err := db.ExecContext(ctx, query, id, owner)
+
+    if err != nil {
+        return err
+    }
+
+    if n, _ := res.RowsAffected(); n == 0 {
+        return sql.ErrNoRows
+    }
+
+    return nil
+}
+
+// Views go with their stories through the foreign key.
+func expireStories(ctx context.Context) error {
+    ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+    defer cancel()
+
+    query := `DELETE FROM story
+            WHERE expires <= now();`
+
+    _, err := db.ExecContext(ctx, query)
+
+    return err
+}
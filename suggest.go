@@ -0,0 +1,223 @@
+package main
+
+import (
+    "context"
+    "net/http"
+    "github.com/gorilla/mux"
+    "github.com/lib/pq"
+    "encoding/json"
+    "log"
+    "time"
+)
+
+const NumSuggestions int = 20
+const suggestionTTL = 10 * time.Minute
+
+type Suggestion struct {
+    URL             string      `json:"url"`
+    FirstName       string      `json:"firstname"`
+    LastName        string      `json:"lastname"`
+    Mutual          int         `json:"mutual"`
+    MutualFriends   []string    `json:"mutualFriends"`
+}
+
+func suggestionHandler(w http.ResponseWriter, r *http.Request) {
+    vars := mux.Vars(r)
+    action := vars["action"]
+    url := vars["url"]
+
+    if !checkProfileOwner(w, r, url) {
+        return
+    }
+
+    switch action {
+    case "get":
+        suggestions, err := loadSuggestions(r.Context(), url)
+
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+            return
+        }
+
+        err = json.NewEncoder(w).Encode(suggestions)
+
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+            log.Println(err)
+        }
+    case "dismiss":
+        other := vars["other"]
+
+        if other == "" {
+            http.NotFound(w, r)
+            return
+        }
+
+        err := dismissSuggestion(r.Context(), url, other)
+
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+            return
+        }
+
+        w.WriteHeader(http.StatusOK)
+    default:
+        http.NotFound(w, r)
+    }
+}
+
+// Suggestions are cached per profile under a versioned key, so a load that
+// races with a connection change can't put back what it invalidated.
+func loadSuggestions(ctx context.Context, url string) ([]Suggestion, error) {
+    var suggestions []Suggestion
+
+    err := readThrough(versionedKey(suggestionsKey(url)), suggestionTTL, &suggestions,
+            func() (interface{}, error) {
+        return querySuggestions(ctx, url)
+    })
+
+    // Empty lists come back from the cache as nil; keep them [] in JSON
+    if err == nil && suggestions == nil {
+        suggestions = []Suggestion{}
+    }
+
+    return suggestions, err
+}
+
+func querySuggestions(ctx context.Context, url string) ([]Suggestion, error) {
+    ctx, cancel := context.WithTimeout(ctx, searchTimeout)
+    defer cancel()
+
+    // Friends of friends ranked by the number of mutual accepted
+    // connections, leaving out anyone already connected or with a pending
+    // request either way, blocked either way, or dismissed.
+    query := `WITH friends AS (SELECT CASE WHEN c.fromurl = $1 THEN c.tourl ELSE c.fromurl END AS url
+                        FROM connection c
+                        WHERE c.accepted
+                        AND $1 IN(c.fromurl, c.tourl)),
+            fof AS (SELECT CASE WHEN c.fromurl = f.url THEN c.tourl ELSE c.fromurl END AS url,
+                            f.url AS via
+                        FROM connection c, friends f
+                        WHERE c.accepted
+                        AND f.url IN(c.fromurl, c.tourl))
+            SELECT p.url, p.firstname, p.lastname, COUNT(DISTINCT fof.via),
+                array_agg(DISTINCT fof.via ORDER BY fof.via)
+            FROM fof, profile p
+            WHERE p.url = fof.url
+            AND fof.url <> $1
+            AND NOT EXISTS (SELECT *
+                            FROM connection c
+                            WHERE $1 IN(c.fromurl, c.tourl)
+                            AND fof.url IN(c.fromurl, c.tourl))
+            AND NOT EXISTS (SELECT *
+                            FROM block b
+                            WHERE (b.blocker = $1 AND b.blocked = fof.url)
+                            OR (b.blocker = fof.url AND b.blocked = $1))
+            AND NOT EXISTS (SELECT *
+                            FROM dismissal d
+                            WHERE d.url = $1
+                            AND d.dismissed = fof.url)
+            AND NOT EXISTS (SELECT *
+                            FROM account a
+                            WHERE a.email = p.email
+                            AND a.deactivated IS NOT NULL)
+            GROUP BY p.url, p.firstname, p.lastname
+            ORDER BY COUNT(DISTINCT fof.via) DESC, p.lastname, p.firstname
+            LIMIT $2;`
+
+    rows, err := db.QueryContext(ctx, query, url, NumSuggestions)
+
+    if err != nil {
+        return nil, err
+    }
+
+    defer rows.Close()
+
+    suggestions := []Suggestion{}
+
+    for rows.Next() {
+        var s Suggestion
+        err = rows.Scan(&s.URL, &s.FirstName, &s.LastName, &s.Mutual, pq.Array(&s.MutualFriends))
+
+        if err != nil {
+            return nil, err
+        }
+
+        suggestions = append(suggestions, s)
+    }
+
+    return suggestions, rows.Err()
+}
+
+func friendUrls(ctx context.Context, url string) (map[string]bool, error) {
+    query := `SELECT CASE WHEN c.fromurl = $1 THEN c.tourl ELSE c.fromurl END
+            FROM connection c
+            WHERE c.accepted
+            AND $1 IN(c.fromurl, c.tourl);`
+
+    rows, err := db.QueryContext(ctx, query, url)
+
+    if err != nil {
+        return nil, err
+    }
+
+    defer rows.Close()
+
+    friends := make(map[string]bool)
+
+    for rows.Next() {
+        var friend string
+        err = rows.Scan(&friend)
+
+        if err != nil {
+            return nil, err
+        }
+
+        friends[friend] = true
+    }
+
+    return friends, rows.Err()
+}
+
+func dismissSuggestion(ctx context.Context, url string, dismissed string) error {
+    ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+    defer cancel()
+
+    query := `INSERT INTO dismissal (url, dismissed)
+            VALUES ($1, $2)
+            ON CONFLICT DO NOTHING;`
+
+    _, err := db.ExecContext(ctx, query, url, dismissed)
+
+    if err == nil {
+        invalidateVersioned(suggestionsKey(url))
+    }
+
+    return err
+}
+
+func suggestionsKey(url string) string {
+    return "suggestions/" + url
+}
+
+// Evicts cached suggestions for the given profiles and their friends, whose
+// friends of friends a change between the profiles can alter.
+func invalidateSuggestions(ctx context.Context, urls ...string) {
+    keys := make([]string, 0, len(urls))
+
+    for _, url := range urls {
+        keys = append(keys, suggestionsKey(url))
+
+        friends, err := friendUrls(ctx, url)
+
+        if err != nil {
+            log.Println("Suggestion invalidation failed:", err)
+        }
+
+        for friend := range friends {
+            keys = append(keys, suggestionsKey(friend))
+        }
+    }
+
+    invalidateVersioned(keys...)
+}
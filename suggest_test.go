@@ -0,0 +1,43 @@
+package main
+
+import (
+    "context"
+    "encoding/json"
+    "testing"
+)
+
+func TestLoadSuggestionsKeepsEmptyLists(t *testing.T) {
+    saved := cache
+    cache = newLRUCache(10)
+    defer func() { cache = saved }()
+
+    url := "lonely"
+    var cached []Suggestion
+
+    // Caches an empty list, as querySuggestions returns for someone with no
+    // friends of friends
+    err := readThrough(versionedKey(suggestionsKey(url)), suggestionTTL, &cached,
+            func() (interface{}, error) {
+        return []Suggestion{}, nil
+    })
+
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    suggestions, err := loadSuggestions(context.Background(), url)
+
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    encoded, err := json.Marshal(suggestions)
+
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if string(encoded) != "[]" {
+        t.Errorf("Empty suggestions encoded as %s, want []", encoded)
+    }
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+    "context"
+    "database/sql"
+    "github.com/lib/pq"
+    "log"
+    "time"
+)
+
+// Posts with a bigger audience than this aren't copied into timelines;
+// readers pick them up with the indexed feed query instead.
+const FanOutLimit int = 5000
+
+// How many of the newest posts a timeline starts with. Older pages come from
+// the indexed query.
+const TimelineBackfill int = 500
+
+// Timelines are dropped and rebuilt on next read once this old, which keeps
+// them from growing without bound and lets idle users' ones go.
+const TimelineLifetime = 30 * 24 * time.Hour
+
+// A user's main feed, read from their materialised timeline where one is
+// ready. Posts that weren't fanned out are merged in from the indexed query.
+// ok is false when the timeline can't answer this page on its own: it isn't
+// built yet, or the page runs past its oldest post.
+func readTimeline(ctx context.Context, user string, before time.Time, limit int) ([]Post, bool, error) {
+    var ready, partial, past bool
+    query := `SELECT ready, since IS NOT NULL, COALESCE($2 <= since, false)
+            FROM timelinestate
+            WHERE owner = $1;`
+
+    err := db.QueryRowContext(ctx, query, user, before).Scan(&ready, &partial, &past)
+
+    if err == sql.ErrNoRows {
+        err = buildTimeline(ctx, user)
+
+        if err != nil {
+            log.Println("Building timeline for " + user + ": " + err.Error())
+            return nil, false, nil
+        }
+
+        err = db.QueryRowContext(ctx, query, user, before).Scan(&ready, &partial, &past)
+    }
+
+    if err == sql.ErrNoRows {
+        return nil, false, nil
+    }
+
+    if err != nil {
+        return nil, false, err
+    }
+
+    if !ready || past {
+        return nil, false, nil
+    }
+
+    query = `SELECT p.id, p.profileurl, p.authorurl, p.timestamp, p.content
+            FROM timeline t, post p
+            WHERE t.owner = $1
+            AND t.timestamp < $2
+            AND p.id = t.postid
+            AND p.deleted IS NULL
+            ORDER BY t.timestamp DESC
+            LIMIT $3;`
+
+    rows, err := db.QueryContext(ctx, query, user, before, limit)
+
+    if err != nil {
+        return nil, false, err
+    }
+
+    timeline, err := scanPosts(rows)
+
+    if err != nil {
+        return nil, false, err
+    }
+
+    if len(timeline) < limit && partial {
+        return nil, false, nil
+    }
+
+    unfanned, err := queryFriendPosts(ctx, user, before, "", limit, true)
+
+    if err != nil {
+        return nil, false, err
+    }
+
+    return mergePosts(timeline, unfanned, limit), true, nil
+}
+
+// Merges two lists of posts, each newest first, dropping posts found in
+// both.
+func mergePosts(a []Post, b []Post, limit int) []Post {
+    merged := make([]Post, 0, limit)
+    seen := make(map[int]bool, limit)
+
+    for len(merged) < limit && (len(a) > 0 || len(b) > 0) {
+        var next Post
+
+        if len(b) == 0 || (len(a) > 0 && !a[0].Timestamp.Before(b[0].Timestamp)) {
+            next, a = a[0], a[1:]
+        } else {
+            next, b = b[0], b[1:]
+        }
+
+        if !seen[next.ID] {
+            seen[next.ID] = true
+            merged = append(merged, next)
+        }
+    }
+
+    return merged
+}
+
+// Starts a user's timeline with their newest posts. The state row is
+// committed first, so posts published while the backfill runs are fanned
+// out to it; until the backfill is done readers use the indexed query. A
+// timeline invalidated part way through is thrown away.
+func buildTimeline(ctx context.Context, user string) error {
+    query := `INSERT INTO timelinestate (owner)
+            VALUES ($1)
+            ON CONFLICT DO NOTHING;`
+
+    res, err := db.ExecContext(ctx, query, user)
+
+    if err != nil {
+        return err
+    }
+
+    // Someone else is building it.
+    if n, _ := res.RowsAffected(); n == 0 {
+        return nil
+    }
+
+    posts, err := queryFriendPosts(ctx, user, time.Now(), "", TimelineBackfill, false)
+
+    if err == nil {
+        query = `INSERT INTO timeline (owner, postid, timestamp)
+                SELECT $1, id, timestamp
+                FROM post
+                WHERE id = ANY($2)
+                ON CONFLICT DO NOTHING;`
+
+        _, err = db.ExecContext(ctx, query, user, pq.Array(postIds(posts)))
+    }
+
+    if err != nil {
+        invalidateTimelines(ctx, user)
+        return err
+    }
+
+    var since *time.Time
+
+    if len(posts) == TimelineBackfill {
+        since = &posts[len(posts) - 1].Timestamp
+    }
+
+    query = `UPDATE timelinestate
+            SET ready = true, since = $2
+            WHERE owner = $1;`
+
+    res, err = db.ExecContext(ctx, query, user, since)
+
+    if err != nil {
+        return err
+    }
+
+    if n, _ := res.RowsAffected(); n == 0 {
+        query = `DELETE FROM timeline
+                WHERE owner = $1
+                AND NOT EXISTS (SELECT *
+                                FROM timelinestate
+                                WHERE owner = $1);`
+
+        _, err = db.ExecContext(ctx, query, user)
+    }
+
+    return err
+}
+
+// Copies a new post into the timelines of everyone who would see it in their
+// main feed: the author, the profile it was posted on, their connections and
+// the author's followers, or the group's members for a group post. Only
+// timelines that have been built are written to. A post is marked fanned out
+// in the same statement; one with too big an audience, or whose fan-out
+// failed, is left for readers to find with the indexed query.
+func fanOut(ctx context.Context, postId int) {
+    ctx, cancel := context.WithTimeout(ctx, feedTimeout)
+    defer cancel()
+
+    query := `WITH p AS (SELECT id, profileurl, authorurl, groupurl, timestamp
+                    FROM post
+                    WHERE id = $1
+                    AND eventid IS NULL
+                    AND deleted IS NULL),
+                audience AS (SELECT p.authorurl AS url FROM p WHERE p.groupurl IS NULL
+                    UNION SELECT p.profileurl FROM p WHERE p.groupurl IS NULL
+                    UNION SELECT c.tourl
+                        FROM connection c, p
+                        WHERE p.groupurl IS NULL
+                        AND c.accepted
+                        AND c.fromurl IN(p.profileurl, p.authorurl)
+                    UNION SELECT c.fromurl
+                        FROM connection c, p
+                        WHERE p.groupurl IS NULL
+                        AND c.accepted
+                        AND c.tourl IN(p.profileurl, p.authorurl)
+                    UNION SELECT f.follower
+                        FROM follow f, p
+                        WHERE p.groupurl IS NULL
+                        AND f.approved
+                        AND f.followed = p.authorurl
+                    UNION SELECT m.profileurl
+                        FROM membership m, p
+                        WHERE m.groupurl = p.groupurl
+                        AND m.status = 'member'),
+                size AS (SELECT COUNT(*) AS n FROM audience),
+                marked AS (UPDATE post
+                    SET fannedout = true
+                    WHERE id IN (SELECT id FROM p)
+                    AND (SELECT n FROM size) <= $2)
+            INSERT INTO timeline (owner, postid, timestamp)
+            SELECT a.url, p.id, p.timestamp
+            FROM audience a, p
+            WHERE (SELECT n FROM size) <= $2
+            AND EXISTS (SELECT *
+                        FROM timelinestate s
+                        WHERE s.owner = a.url)
+            ON CONFLICT DO NOTHING;`
+
+    _, err := db.ExecContext(ctx, query, postId, FanOutLimit)
+
+    if err != nil {
+        log.Println("Timeline fan-out failed:", err)
+    }
+}
+
+// Drops the timelines of profiles whose connections, follows or groups have
+// changed. They are rebuilt on next read.
+func invalidateTimelines(ctx context.Context, urls ...string) {
+    ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+    defer cancel()
+
+    queries := []string{
+        `DELETE FROM timelinestate
+            WHERE owner = ANY($1);`,
+        `DELETE FROM timeline
+            WHERE owner = ANY($1);`,
+    }
+
+    for _, query := range queries {
+        _, err := db.ExecContext(ctx, query, pq.Array(urls))
+
+        if err != nil {
+            log.Println("Timeline invalidation failed:", err)
+            return
+        }
+    }
+}
+
+func expireTimelines(ctx context.Context) error {
+    ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+    defer cancel()
+
+    query := `DELETE FROM timelinestate
+            WHERE built < now() - $1 * interval '1 second'
+            RETURNING owner;`
+
+    rows, err := db.QueryContext(ctx, query, TimelineLifetime.Seconds())
+
+    if err != nil {
+        return err
+    }
+
+    var owners []string
+
+    for rows.Next() {
+        var owner string
+        err = rows.Scan(&owner)
+
+        if err != nil {
+            rows.Close()
+            return err
+        }
+
+        owners = append(owners, owner)
+    }
+
+    rows.Close()
+
+    if err = rows.Err(); err != nil {
+        return err
+    }
+
+    query = `DELETE FROM timeline
+            WHERE owner = ANY($1);`
+
+    _, err = db.ExecContext(ctx, query, pq.Array(owners))
+
+    return err
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+    "context"
+    "database/sql"
+    _ "github.com/lib/pq"
+    "os"
+    "strconv"
+    "testing"
+    "time"
+)
+
+func TestMergePosts(t *testing.T) {
+    base := time.Date(2024, time.March, 1, 12, 0, 0, 0, time.UTC)
+
+    post := func(id int, minutes int) Post {
+        return Post{ID: id, Timestamp: base.Add(-time.Duration(minutes) * time.Minute)}
+    }
+
+    tests := []struct {
+        name    string
+        a       []Post
+        b       []Post
+        limit   int
+        want    []int
+    }{
+        {"both empty", nil, nil, 5, []int{}},
+        {"only a", []Post{post(1, 0), post(2, 1)}, nil, 5, []int{1, 2}},
+        {"only b", nil, []Post{post(1, 0), post(2, 1)}, 5, []int{1, 2}},
+        {"interleaved newest first", []Post{post(1, 0), post(3, 2), post(5, 4)},
+                []Post{post(2, 1), post(4, 3), post(6, 5)}, 10, []int{1, 2, 3, 4, 5, 6}},
+        {"duplicates dropped", []Post{post(1, 0), post(2, 1), post(3, 2)},
+                []Post{post(2, 1), post(3, 2), post(4, 3)}, 10, []int{1, 2, 3, 4}},
+        {"a first on equal timestamps", []Post{post(1, 0)}, []Post{post(2, 0)}, 10, []int{1, 2}},
+        {"limit", []Post{post(1, 0), post(3, 2), post(5, 4)},
+                []Post{post(2, 1), post(4, 3)}, 3, []int{1, 2, 3}},
+        {"duplicates don't count towards the limit", []Post{post(1, 0), post(2, 1)},
+                []Post{post(1, 0), post(2, 1), post(3, 2)}, 3, []int{1, 2, 3}},
+        {"zero limit", []Post{post(1, 0)}, []Post{post(2, 1)}, 0, []int{}},
+    }
+
+    for _, test := range tests {
+        got := postIds(mergePosts(test.a, test.b, test.limit))
+
+        if !equalIds(got, test.want) {
+            t.Errorf("%s: merged %v, want %v", test.name, got, test.want)
+        }
+    }
+}
+
+// Points db at the database in NETWRK_TEST_DB, a connection string for a
+// netwrk database whose base tables exist, and brings its schema up to date.
+// Tests that need one are skipped without it.
+func testDB(tb testing.TB) {
+    dsn := os.Getenv("NETWRK_TEST_DB")
+
+    if dsn == "" {
+        tb.Skip("NETWRK_TEST_DB not set")
+    }
+
+    var err error
+    db, err = sql.Open("postgres", dsn)
+
+    if err != nil {
+        tb.Fatal(err)
+    }
+
+    tb.Cleanup(func() {
+        db.Close()
+    })
+
+    err = migrate(context.Background())
+
+    if err != nil {
+        tb.Fatal(err)
+    }
+}
+
+// Creates a profile connected to friends others, and posts by those friends
+// on their own walls a minute apart, newest first. Posts are marked fanned
+// out, as ones from before the timeline was built would be. Returns the
+// profile; the friends are the same url with 1 to friends in place of its 0.
+// Everything is removed when the test ends.
+func testNetwork(tb testing.TB, friends int, posts int) string {
+    prefix := "timeline-test-" + strconv.FormatInt(time.Now().UnixNano(), 36) + "-"
+    ctx := context.Background()
+
+    queries := []string{
+        `INSERT INTO account (email, dob, password)
+            SELECT $1::text || i || '@example.com', '1990-01-01', ''
+            FROM generate_series(0, $2) i;`,
+        `INSERT INTO profile (url, firstname, lastname, email, dob, bio, private)
+            SELECT $1::text || i, 'Test', 'User ' || i, $1::text || i || '@example.com',
+                '1990-01-01', '', false
+            FROM generate_series(0, $2) i;`,
+        `INSERT INTO connection (fromurl, tourl, fromdescriptor, todescriptor, type, accepted)
+            SELECT $1::text || '0', $1::text || i, '', '', 'friend', true
+            FROM generate_series(1, $2) i;`,
+        `INSERT INTO post (profileurl, authorurl, content, timestamp, fannedout)
+            SELECT $1::text || (1 + i % $2), $1::text || (1 + i % $2), 'Post ' || i,
+                now() - (i + 1) * interval '1 minute', true
+            FROM generate_series(0, $3 - 1) i;`,
+    }
+
+    tb.Cleanup(func() {
+        cleanup := []string{
+            `DELETE FROM timeline WHERE owner LIKE $1 || '%';`,
+            `DELETE FROM timelinestate WHERE owner LIKE $1 || '%';`,
+            `DELETE FROM post WHERE profileurl LIKE $1 || '%';`,
+            `DELETE FROM connection WHERE fromurl LIKE $1 || '%';`,
+            `DELETE FROM profile WHERE url LIKE $1 || '%';`,
+            `DELETE FROM account WHERE email LIKE $1 || '%';`,
+        }
+
+        for _, query := range cleanup {
+            if _, err := db.ExecContext(ctx, query, prefix); err != nil {
+                tb.Error(err)
+            }
+        }
+    })
+
+    for i, query := range queries {
+        args := []interface{}{prefix, friends}
+
+        if i == len(queries) - 1 {
+            args = append(args, posts)
+        }
+
+        if _, err := db.ExecContext(ctx, query, args...); err != nil {
+            tb.Fatal(err)
+        }
+    }
+
+    return prefix + "0"
+}
+
+func newestPosts(tb testing.TB, user string, limit int) []Post {
+    posts, err := queryFriendPosts(context.Background(), user, time.Now(), "", limit, false)
+
+    if err != nil {
+        tb.Fatal(err)
+    }
+
+    return posts
+}
+
+func TestReadTimeline(t *testing.T) {
+    testDB(t)
+    user := testNetwork(t, 3, 30)
+    ctx := context.Background()
+    want := newestPosts(t, user, PostsPerRequest)
+
+    // The first read builds the timeline
+    posts, ok, err := readTimeline(ctx, user, time.Now(), PostsPerRequest)
+
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if !ok {
+        t.Fatal("Timeline wasn't built on first read")
+    }
+
+    if !equalIds(postIds(posts), postIds(want)) {
+        t.Errorf("Timeline %v, want %v", postIds(posts), postIds(want))
+    }
+
+    // A new post reaches it by fan-out
+    var id int
+    query := `INSERT INTO post (profileurl, authorurl, content)
+            VALUES ($1, $1, 'New')
+            RETURNING id;`
+
+    err = db.QueryRowContext(ctx, query, user[:len(user) - 1] + "2").Scan(&id)
+
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    fanOut(ctx, id)
+
+    var fanned bool
+    err = db.QueryRowContext(ctx, `SELECT fannedout FROM post WHERE id = $1;`, id).Scan(&fanned)
+
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    if !fanned {
+        t.Error("Post with a small audience wasn't fanned out")
+    }
+
+    posts, ok, err = readTimeline(ctx, user, time.Now(), PostsPerRequest)
+
+    if err != nil || !ok {
+        t.Fatal("Reading built timeline:", ok, err)
+    }
+
+    if len(posts) == 0 || posts[0].ID != id {
+        t.Errorf("Timeline starts %v, want new post %d first", postIds(posts), id)
+    }
+}
+
+func TestReadTimelinePartialBackfill(t *testing.T) {
+    testDB(t)
+    user := testNetwork(t, 3, TimelineBackfill + 50)
+    ctx := context.Background()
+    all := newestPosts(t, user, TimelineBackfill + 50)
+
+    if _, _, err := readTimeline(ctx, user, time.Now(), PostsPerRequest); err != nil {
+        t.Fatal(err)
+    }
+
+    var since *time.Time
+    err := db.QueryRowContext(ctx, `SELECT since FROM timelinestate WHERE owner = $1;`,
+            user).Scan(&since)
+
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    oldest := all[TimelineBackfill - 1].Timestamp
+
+    if since == nil || !since.Equal(oldest) {
+        t.Fatalf("Timeline since %v, want oldest backfilled post at %v", since, oldest)
+    }
+
+    tests := []struct {
+        name    string
+        before  time.Time
+        ok      bool
+    }{
+        {"newest page", time.Now(), true},
+        {"full page within the backfill", all[TimelineBackfill - PostsPerRequest - 1].Timestamp, true},
+        {"page running past the backfill", all[TimelineBackfill - 5].Timestamp, false},
+        {"page before the backfill", oldest, false},
+    }
+
+    for _, test := range tests {
+        posts, ok, err := readTimeline(ctx, user, test.before, PostsPerRequest)
+
+        if err != nil {
+            t.Fatal(err)
+        }
+
+        if ok != test.ok {
+            t.Errorf("%s: ok = %v, want %v", test.name, ok, test.ok)
+            continue
+        }
+
+        if ok && len(posts) != PostsPerRequest {
+            t.Errorf("%s: %d posts, want %d", test.name, len(posts), PostsPerRequest)
+        }
+    }
+
+    // Older pages fall back to the indexed query
+    posts, err := getFriendPosts(ctx, user, oldest, "", PostsPerRequest)
+
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    want := all[TimelineBackfill:TimelineBackfill + PostsPerRequest]
+
+    if !equalIds(postIds(posts), postIds(want)) {
+        t.Errorf("Page before the backfill %v, want %v", postIds(posts), postIds(want))
+    }
+}
+
+func TestFanOutLimit(t *testing.T) {
+    testDB(t)
+    author := testNetwork(t, FanOutLimit, 0)
+    friend := author[:len(author) - 1] + "1"
+    ctx := context.Background()
+
+    if _, _, err := readTimeline(ctx, friend, time.Now(), PostsPerRequest); err != nil {
+        t.Fatal(err)
+    }
+
+    // The author and their connections are one more than the limit
+    var id int
+    query := `INSERT INTO post (profileurl, authorurl, content)
+            VALUES ($1, $1, 'To everyone')
+            RETURNING id;`
+
+    if err := db.QueryRowContext(ctx, query, author).Scan(&id); err != nil {
+        t.Fatal(err)
+    }
+
+    fanOut(ctx, id)
+
+    var fanned, copied bool
+    query = `SELECT p.fannedout, EXISTS (SELECT * FROM timeline t WHERE t.postid = p.id)
+            FROM post p
+            WHERE p.id = $1;`
+
+    if err := db.QueryRowContext(ctx, query, id).Scan(&fanned, &copied); err != nil {
+        t.Fatal(err)
+    }
+
+    if fanned || copied {
+        t.Errorf("Post over the fan-out limit: fannedout = %v, copied = %v", fanned, copied)
+    }
+
+    posts, ok, err := readTimeline(ctx, friend, time.Now(), PostsPerRequest)
+
+    if err != nil || !ok {
+        t.Fatal("Reading built timeline:", ok, err)
+    }
+
+    if len(posts) == 0 || posts[0].ID != id {
+        t.Errorf("Timeline %v, want post %d merged in from the indexed query", postIds(posts), id)
+    }
+}
+
+// Compares reading a page of a well-connected user's feed with the indexed
+// query against reading it from their timeline.
+func BenchmarkGetFriendPosts(b *testing.B) {
+    testDB(b)
+    user := testNetwork(b, 10000, 50000)
+    ctx := context.Background()
+
+    b.Run("indexed", func(b *testing.B) {
+        for i := 0; i < b.N; i++ {
+            _, err := queryFriendPosts(ctx, user, time.Now(), "", PostsPerRequest, false)
+
+            if err != nil {
+                b.Fatal(err)
+            }
+        }
+    })
+
+    if err := buildTimeline(ctx, user); err != nil {
+        b.Fatal(err)
+    }
+
+    b.Run("timeline", func(b *testing.B) {
+        for i := 0; i < b.N; i++ {
+            _, ok, err := readTimeline(ctx, user, time.Now(), PostsPerRequest)
+
+            if err != nil {
+                b.Fatal(err)
+            }
+
+            if !ok {
+                b.Fatal("Timeline not ready")
+            }
+        }
+    })
+}
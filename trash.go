@@ -0,0 +1,207 @@
+package main
+
+import (
+    "context"
+    "net/http"
+    "github.com/gorilla/mux"
+    "database/sql"
+    _ "github.com/lib/pq"
+    "encoding/json"
+    "log"
+    "time"
+)
+
+// Deleted posts and comments can be restored by their authors for this
+// long before they and everything depending on them are removed for good.
+const TrashRetention = 30 * 24 * time.Hour
+
+type TrashItem struct {
+    Kind        string      `json:"kind"`
+    ID          int         `json:"id"`
+    PostId      int         `json:"postId,omitempty"`
+    Content     string      `json:"content"`
+    Timestamp   time.Time   `json:"timestamp"`
+    Deleted     time.Time   `json:"deleted"`
+}
+
+// get lists the user's recently deleted posts and comments; restore/{kind}/{id}
+// brings one back.
+func trashHandler(w http.ResponseWriter, r *http.Request) {
+    vars := mux.Vars(r)
+    action := vars["action"]
+
+    email, ok := checkAuthorisation(w, r)
+
+    if !ok {
+        return
+    }
+
+    user, err := profileUrlForEmail(r.Context(), email)
+
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusForbidden)
+        return
+    }
+
+    switch action {
+    case "get":
+        items, err := loadTrash(r.Context(), user)
+
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+            return
+        }
+
+        err = json.NewEncoder(w).Encode(items)
+
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+            log.Println(err)
+        }
+    case "restore":
+        kind := vars["kind"]
+
+        if kind != "post" && kind != "comment" {
+            http.NotFound(w, r)
+            return
+        }
+
+        err = restoreItem(r.Context(), kind, vars["id"], user)
+
+        if err == sql.ErrNoRows {
+            http.NotFound(w, r)
+            return
+        }
+
+        if err != nil {
+            http.Error(w, err.Error(), http.StatusInternalServerError)
+            return
+        }
+
+        w.WriteHeader(http.StatusOK)
+    default:
+        http.NotFound(w, r)
+    }
+}
+
+func loadTrash(ctx context.Context, user string) ([]TrashItem, error) {
+    ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+    defer cancel()
+
+    query := `SELECT 'post', id, 0, content, timestamp, deleted
+            FROM post
+            WHERE authorurl = $1
+            AND deleted > $2
+            UNION ALL
+            SELECT 'comment', id, postid, content, timestamp, deleted
+            FROM comment
+            WHERE authorurl = $1
+            AND deleted > $2
+            ORDER BY 6 DESC;`
+
+    rows, err := db.QueryContext(ctx, query, user, time.Now().Add(-TrashRetention))
+
+    if err != nil {
+        return nil, err
+    }
+
+    defer rows.Close()
+
+    items := []TrashItem{}
+
+    for rows.Next() {
+        var item TrashItem
+        err = rows.Scan(&item.Kind, &item.ID, &item.PostId, &item.Content, &item.Timestamp,
+                &item.Deleted)
+
+        if err != nil {
+            return nil, err
+        }
+
+        items = append(items, item)
+    }
+
+    return items, rows.Err()
+}
+
+// A restored comment stays hidden while the post it is on is deleted.
+func restoreItem(ctx context.Context, table string, id string, user string) error {
+    ctx, cancel := context.WithTimeout(ctx, queryTimeout)
+    defer cancel()
+
+    query := `UPDATE ` + table + `
+            SET deleted = NULL
+            WHERE id = $1
+            AND authorurl = $2
+            AND deleted > $3;`
+
+    res, err := db.ExecContext(ctx, query, id, user, time.Now().Add(-TrashRetention))
+
+    if err != nil {
+        return err
+    }
+
+    if n, _ := res.RowsAffected(); n == 0 {
+        return sql.ErrNoRows
+    }
+
+    return nil
+}
+
+// Removes posts and comments deleted longer ago than TrashRetention, along
+// with the reactions and notifications on them and the comments on expired
+// posts. Entities and revisions go with them through their foreign keys.
+func purgeTrash(ctx context.Context) error {
+    ctx, cancel := context.WithTimeout(ctx, purgeTimeout)
+    defer cancel()
+
+    tx, err := db.BeginTx(ctx, nil)
+
+    if err != nil {
+        return err
+    }
+
+    defer tx.Rollback()
+
+    posts := `SELECT id FROM post WHERE deleted < $1`
+    comments := `SELECT id FROM comment WHERE deleted < $1 OR postid IN (` + posts + `)`
+
+    cutoff := time.Now().Add(-TrashRetention)
+
+    query := `DELETE FROM reaction
+            WHERE (post = true AND postid IN (` + posts + `))
+            OR (post = false AND commentid IN (` + comments + `))
+            RETURNING post, COALESCE(postid, 0);`
+
+    reacted, err := deleteReactions(ctx, tx, query, cutoff)
+
+    if err != nil {
+        return err
+    }
+
+    queries := []string{
+        `DELETE FROM notification
+            WHERE postid IN (` + posts + `)
+            OR commentid IN (` + comments + `);`,
+        `DELETE FROM comment
+            WHERE id IN (` + comments + `);`,
+        `DELETE FROM post
+            WHERE deleted < $1;`,
+    }
+
+    for _, query := range queries {
+        _, err = tx.ExecContext(ctx, query, cutoff)
+
+        if err != nil {
+            return err
+        }
+    }
+
+    err = tx.Commit()
+
+    if err == nil {
+        invalidateReactions(reacted...)
+    }
+
+    return err
+}